@@ -0,0 +1,42 @@
+-- Outbox records written by the services and relayed by the outbox processor.
+-- Timestamps are stored in UTC.
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id                VARCHAR(64)  NOT NULL PRIMARY KEY,
+    name              VARCHAR(255) NOT NULL,
+    ordering_key      VARCHAR(255),
+    payload           LONGTEXT     NOT NULL,
+    headers           JSON,
+    status            VARCHAR(32)  NOT NULL DEFAULT 'PENDING',
+    created_at        DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    processed_at      DATETIME(6),
+    last_attempt_time DATETIME(6),
+    attempts          INT          NOT NULL DEFAULT 0,
+    next_attempt_at   DATETIME(6),
+    last_error        TEXT,
+    history           JSON,
+    owner             VARCHAR(255),
+    lease_expires_at  DATETIME(6),
+    version           BIGINT       NOT NULL DEFAULT 0,
+    INDEX outbox_events_status_created_at (status, created_at),
+    INDEX outbox_events_ordering_key_created_at (ordering_key, created_at)
+);
+
+CREATE TABLE IF NOT EXISTS outbox_dead_letters (
+    id         VARCHAR(64)  NOT NULL PRIMARY KEY,
+    name       VARCHAR(255) NOT NULL,
+    payload    LONGTEXT     NOT NULL,
+    created_at DATETIME(6)  NOT NULL,
+    dead_at    DATETIME(6)  NOT NULL,
+    attempts   INT          NOT NULL,
+    last_error TEXT         NOT NULL,
+    history    JSON,
+    emitter    VARCHAR(255) NOT NULL,
+    INDEX outbox_dead_letters_dead_at (dead_at)
+);
+
+-- Binlog positions, as GTID sets, the processor resumes streaming from.
+CREATE TABLE IF NOT EXISTS outbox_checkpoints (
+    id         VARCHAR(255) NOT NULL PRIMARY KEY,
+    position   TEXT         NOT NULL,
+    updated_at DATETIME(6)  NOT NULL
+);
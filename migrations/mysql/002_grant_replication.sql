@@ -0,0 +1,3 @@
+-- Lets the processor read the binlog of the outbox table, with OUTBOX_MYSQL_STREAM=binlog.
+-- 'outbox' is the user docker-compose creates; grant the privileges to the processor's own user elsewhere.
+GRANT REPLICATION SLAVE, REPLICATION CLIENT ON *.* TO 'outbox'@'%';
@@ -0,0 +1,43 @@
+-- Outbox records written by the services and relayed by the outbox processor.
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id                TEXT PRIMARY KEY,
+    name              TEXT        NOT NULL,
+    ordering_key      TEXT,
+    payload           TEXT        NOT NULL,
+    headers           JSONB,
+    status            TEXT        NOT NULL DEFAULT 'PENDING',
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT now(),
+    processed_at      TIMESTAMPTZ,
+    last_attempt_time TIMESTAMPTZ,
+    attempts          INTEGER     NOT NULL DEFAULT 0,
+    next_attempt_at   TIMESTAMPTZ,
+    last_error        TEXT,
+    history           JSONB,
+    owner             TEXT,
+    lease_expires_at  TIMESTAMPTZ,
+    version           BIGINT      NOT NULL DEFAULT 0
+);
+
+-- Polled by the processor for records to claim; finished records, the bulk of the
+-- table, are left out.
+CREATE INDEX IF NOT EXISTS outbox_events_unfinished_created_at
+    ON outbox_events (created_at)
+    WHERE status IN ('PENDING', 'ERROR', 'IN_PROGRESS');
+
+CREATE INDEX IF NOT EXISTS outbox_events_ordering_key_created_at
+    ON outbox_events (ordering_key, created_at)
+    WHERE ordering_key IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS outbox_dead_letters (
+    id         TEXT PRIMARY KEY,
+    name       TEXT        NOT NULL,
+    payload    TEXT        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    dead_at    TIMESTAMPTZ NOT NULL,
+    attempts   INTEGER     NOT NULL,
+    last_error TEXT        NOT NULL,
+    history    JSONB,
+    emitter    TEXT        NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS outbox_dead_letters_dead_at ON outbox_dead_letters (dead_at);
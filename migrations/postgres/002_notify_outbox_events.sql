@@ -0,0 +1,17 @@
+-- Wakes the outbox processors up as soon as a record is written or scheduled for
+-- another attempt, rather than at their next poll. Notifications are delivered on
+-- commit, and identical ones raised within a transaction are delivered only once.
+CREATE OR REPLACE FUNCTION notify_outbox_events() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('outbox_events', '');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS outbox_events_notify ON outbox_events;
+
+CREATE TRIGGER outbox_events_notify
+    AFTER INSERT OR UPDATE OF status ON outbox_events
+    FOR EACH ROW
+    WHEN (NEW.status IN ('PENDING', 'ERROR'))
+    EXECUTE FUNCTION notify_outbox_events();
@@ -0,0 +1,40 @@
+-- Outbox records written by the services and relayed by the outbox processor.
+-- Timestamps are UTC text such as 2024-01-02 03:04:05.123456+00:00, which
+-- compares in time order.
+PRAGMA journal_mode = WAL;
+
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id                TEXT     NOT NULL PRIMARY KEY,
+    name              TEXT     NOT NULL,
+    ordering_key      TEXT,
+    payload           TEXT     NOT NULL,
+    headers           TEXT,
+    status            TEXT     NOT NULL DEFAULT 'PENDING',
+    created_at        DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    processed_at      DATETIME,
+    last_attempt_time DATETIME,
+    attempts          INTEGER  NOT NULL DEFAULT 0,
+    next_attempt_at   DATETIME,
+    last_error        TEXT,
+    history           TEXT,
+    owner             TEXT,
+    lease_expires_at  DATETIME,
+    version           INTEGER  NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS outbox_events_status_created_at ON outbox_events (status, created_at);
+CREATE INDEX IF NOT EXISTS outbox_events_ordering_key_created_at ON outbox_events (ordering_key, created_at);
+
+CREATE TABLE IF NOT EXISTS outbox_dead_letters (
+    id         TEXT     NOT NULL PRIMARY KEY,
+    name       TEXT     NOT NULL,
+    payload    TEXT     NOT NULL,
+    created_at DATETIME NOT NULL,
+    dead_at    DATETIME NOT NULL,
+    attempts   INTEGER  NOT NULL,
+    last_error TEXT     NOT NULL,
+    history    TEXT,
+    emitter    TEXT     NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS outbox_dead_letters_dead_at ON outbox_dead_letters (dead_at);
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type (
+	// CheckpointStore remembers how far a stream reader got, e.g. the last sequence
+	// number processed on a shard or a change stream resume token, so it can resume
+	// from there after a restart.
+	CheckpointStore interface {
+		Get(ctx context.Context, key string) (string, error)
+		Save(ctx context.Context, key, position string) error
+	}
+
+	Checkpoint struct {
+		Id        string    `json:"id" bson:"_id"`
+		Position  string    `json:"position" bson:"position"`
+		UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+	}
+
+	DynamoCheckpointStore struct {
+		dynamoClient *dynamodb.DynamoDB
+		tableName    string
+	}
+
+	MongoCheckpointStore struct {
+		collection *mongo.Collection
+	}
+)
+
+func NewDynamoCheckpointStore(dynamoClient *dynamodb.DynamoDB, tableName string) CheckpointStore {
+	return &DynamoCheckpointStore{dynamoClient: dynamoClient, tableName: tableName}
+}
+
+func (s *DynamoCheckpointStore) Get(ctx context.Context, key string) (string, error) {
+	itemKey, err := dynamodbattribute.MarshalMap(map[string]string{"id": key})
+	if err != nil {
+		return "", err
+	}
+	item, err := s.dynamoClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.tableName),
+		Key:            itemKey,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	var checkpoint Checkpoint
+	if err := dynamodbattribute.UnmarshalMap(item.Item, &checkpoint); err != nil {
+		return "", err
+	}
+	return checkpoint.Position, nil
+}
+
+func (s *DynamoCheckpointStore) Save(ctx context.Context, key, position string) error {
+	item, err := dynamodbattribute.MarshalMap(Checkpoint{Id: key, Position: position, UpdatedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = s.dynamoClient.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item:      item,
+	})
+	return err
+}
+
+func NewMongoCheckpointStore(collection *mongo.Collection) CheckpointStore {
+	return &MongoCheckpointStore{collection: collection}
+}
+
+func (s *MongoCheckpointStore) Get(ctx context.Context, key string) (string, error) {
+	var checkpoint Checkpoint
+	err := s.collection.FindOne(ctx, bson.M{"_id": key}).Decode(&checkpoint)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return checkpoint.Position, nil
+}
+
+func (s *MongoCheckpointStore) Save(ctx context.Context, key, position string) error {
+	checkpoint := Checkpoint{Id: key, Position: position, UpdatedAt: time.Now()}
+	opts := options.Replace().SetUpsert(true)
+	_, err := s.collection.ReplaceOne(ctx, bson.M{"_id": key}, checkpoint, opts)
+	return err
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func retryPolicyFromEnv() RetryPolicy {
+	policy := DefaultRetryPolicy()
+	return RetryPolicy{
+		MaxAttempts: envInt("OUTBOX_MAX_ATTEMPTS", policy.MaxAttempts),
+		BaseBackoff: envDuration("OUTBOX_BASE_BACKOFF", policy.BaseBackoff),
+		MaxBackoff:  envDuration("OUTBOX_MAX_BACKOFF", policy.MaxBackoff),
+		Jitter:      envFloat("OUTBOX_BACKOFF_JITTER", policy.Jitter),
+	}
+}
+
+// orderingPolicyFromEnv reads the event names that opt out of ordered delivery as a
+// comma-separated list, e.g. OUTBOX_UNORDERED_EVENTS=PAYMENT_FAILED.
+func orderingPolicyFromEnv() OrderingPolicy {
+	policy := DefaultOrderingPolicy()
+	for _, name := range strings.Split(envString("OUTBOX_UNORDERED_EVENTS", ""), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			policy.Unordered[name] = true
+		}
+	}
+	policy.RecheckDelay = envDuration("OUTBOX_ORDERING_RECHECK_DELAY", policy.RecheckDelay)
+	return policy
+}
+
+// kafkaRoutingFromEnv reads the topic routing table as comma-separated name=topic
+// pairs, e.g. OUTBOX_KAFKA_TOPICS=PAYMENT_PROCESSED=payments,PAYMENT_FAILED=payments.
+func kafkaRoutingFromEnv() KafkaRouting {
+	routing := KafkaRouting{
+		Topics:       map[string]string{},
+		DefaultTopic: envString("OUTBOX_KAFKA_DEFAULT_TOPIC", ""),
+		TopicPrefix:  envString("OUTBOX_KAFKA_TOPIC_PREFIX", ""),
+		PartitionKey: envString("OUTBOX_KAFKA_PARTITION_KEY", ""),
+	}
+	for _, entry := range strings.Split(envString("OUTBOX_KAFKA_TOPICS", ""), ",") {
+		name, topic, ok := strings.Cut(entry, "=")
+		if !ok {
+			if strings.TrimSpace(entry) != "" {
+				slog.Warn("Invalid Kafka topic route in environment, ignoring it", "key", "OUTBOX_KAFKA_TOPICS", "value", entry)
+			}
+			continue
+		}
+		routing.Topics[strings.TrimSpace(name)] = strings.TrimSpace(topic)
+	}
+	return routing
+}
+
+// rabbitMqTopologyFromEnv loads the topology file named by OUTBOX_RABBITMQ_TOPOLOGY,
+// or the default topology when it is not set.
+func rabbitMqTopologyFromEnv() (RabbitMqTopology, error) {
+	path := envString("OUTBOX_RABBITMQ_TOPOLOGY", "")
+	if path == "" {
+		return DefaultRabbitMqTopology(), nil
+	}
+	return LoadRabbitMqTopology(path)
+}
+
+// processorIdFromEnv identifies this replica as the owner of the records it claims.
+func processorIdFromEnv() string {
+	if id, ok := os.LookupEnv("OUTBOX_PROCESSOR_ID"); ok && id != "" {
+		return id
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "outbox-processor"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+func envString(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("Invalid integer in environment, using default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func envFloat(key string, fallback float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		slog.Warn("Invalid number in environment, using default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("Invalid duration in environment, using default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func envBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Warn("Invalid boolean in environment, using default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return parsed
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strconv"
+	"time"
+)
+
+const DeadLetterEventName = "OUTBOX_DEAD_LETTER"
+
+type (
+	DeadLetter struct {
+		Id        string    `json:"id" bson:"_id"`
+		Name      string    `json:"name" bson:"name"`
+		Payload   string    `json:"payload" bson:"payload"`
+		CreatedAt time.Time `json:"created_at" bson:"created_at"`
+		DeadAt    time.Time `json:"dead_at" bson:"dead_at" dynamodbav:"dead_at,unixtime"`
+		Attempts  int       `json:"attempts" bson:"attempts"`
+		LastError string    `json:"last_error" bson:"last_error"`
+		History   []Attempt `json:"history" bson:"history"`
+		Emitter   string    `json:"emitter" bson:"emitter"`
+	}
+
+	DeadLetterFilter struct {
+		Ids  []string
+		Name string
+		From time.Time
+		To   time.Time
+	}
+
+	// DeadLetterSink must be idempotent on the record id: a record that could not
+	// reach every sink is sent to all of them again. Repositories overwrite the dead
+	// letter stored under the id, and EmitterDeadLetterSink publishes it with the id
+	// as message id for consumers to drop duplicates.
+	DeadLetterSink interface {
+		Send(ctx context.Context, deadLetter *DeadLetter) error
+	}
+
+	DeadLetterRepository interface {
+		DeadLetterSink
+		Find(ctx context.Context, filter DeadLetterFilter) ([]*DeadLetter, error)
+		Delete(ctx context.Context, id string) error
+	}
+
+	MongoDeadLetterRepository struct {
+		collection *mongo.Collection
+	}
+
+	DynamoDeadLetterRepository struct {
+		dynamoClient *dynamodb.DynamoDB
+		tableName    string
+	}
+
+	// EmitterDeadLetterSink forwards dead letters to a broker dead-letter queue through an EventEmitter.
+	EmitterDeadLetterSink struct {
+		eventEmitter EventEmitter
+	}
+
+	DeadLetterSinks []DeadLetterSink
+)
+
+func NewDeadLetter(outbox *Outbox, emitter string) *DeadLetter {
+	return &DeadLetter{
+		Id:        outbox.Id,
+		Name:      outbox.Name,
+		Payload:   outbox.Payload,
+		CreatedAt: outbox.CreatedAt,
+		DeadAt:    time.Now().UTC(),
+		Attempts:  outbox.Attempts,
+		LastError: outbox.LastError,
+		History:   outbox.History,
+		Emitter:   emitter,
+	}
+}
+
+func (f DeadLetterFilter) matches(deadLetter *DeadLetter) bool {
+	if f.Name != "" && deadLetter.Name != f.Name {
+		return false
+	}
+	if !f.From.IsZero() && deadLetter.DeadAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && deadLetter.DeadAt.After(f.To) {
+		return false
+	}
+	return true
+}
+
+func NewMongoDeadLetterRepository(collection *mongo.Collection) *MongoDeadLetterRepository {
+	return &MongoDeadLetterRepository{collection: collection}
+}
+
+func NewDynamoDeadLetterRepository(dynamoClient *dynamodb.DynamoDB, tableName string) DeadLetterRepository {
+	return &DynamoDeadLetterRepository{dynamoClient: dynamoClient, tableName: tableName}
+}
+
+func NewEmitterDeadLetterSink(eventEmitter EventEmitter) *EmitterDeadLetterSink {
+	return &EmitterDeadLetterSink{eventEmitter: eventEmitter}
+}
+
+func (r *MongoDeadLetterRepository) Send(ctx context.Context, deadLetter *DeadLetter) error {
+	opts := options.Replace().SetUpsert(true)
+	_, err := r.collection.ReplaceOne(ctx, bson.M{"_id": deadLetter.Id}, deadLetter, opts)
+	return err
+}
+
+func (r *MongoDeadLetterRepository) Find(ctx context.Context, filter DeadLetterFilter) ([]*DeadLetter, error) {
+	query := bson.M{}
+	if len(filter.Ids) > 0 {
+		query["_id"] = bson.M{"$in": filter.Ids}
+	}
+	if filter.Name != "" {
+		query["name"] = filter.Name
+	}
+	deadAt := bson.M{}
+	if !filter.From.IsZero() {
+		deadAt["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		deadAt["$lte"] = filter.To
+	}
+	if len(deadAt) > 0 {
+		query["dead_at"] = deadAt
+	}
+	cursor, err := r.collection.Find(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	var deadLetters []*DeadLetter
+	if err := cursor.All(ctx, &deadLetters); err != nil {
+		return nil, err
+	}
+	return deadLetters, nil
+}
+
+func (r *MongoDeadLetterRepository) Delete(ctx context.Context, id string) error {
+	_, err := r.collection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (r *DynamoDeadLetterRepository) Send(ctx context.Context, deadLetter *DeadLetter) error {
+	item, err := dynamodbattribute.MarshalMap(deadLetter)
+	if err != nil {
+		return err
+	}
+	_, err = r.dynamoClient.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.tableName),
+		Item:      item,
+	})
+	return err
+}
+
+func (r *DynamoDeadLetterRepository) Find(ctx context.Context, filter DeadLetterFilter) ([]*DeadLetter, error) {
+	if len(filter.Ids) > 0 {
+		return r.findByIds(ctx, filter)
+	}
+	input := &dynamodb.ScanInput{TableName: aws.String(r.tableName)}
+	if condition, ok := dynamoDeadLetterCondition(filter); ok {
+		expr, err := expression.NewBuilder().WithFilter(condition).Build()
+		if err != nil {
+			return nil, err
+		}
+		input.FilterExpression = expr.Filter()
+		input.ExpressionAttributeNames = expr.Names()
+		input.ExpressionAttributeValues = expr.Values()
+	}
+	var deadLetters []*DeadLetter
+	var unmarshalErr error
+	err := r.dynamoClient.ScanPagesWithContext(ctx, input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		var items []*DeadLetter
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &items); unmarshalErr != nil {
+			return false
+		}
+		deadLetters = append(deadLetters, items...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deadLetters, unmarshalErr
+}
+
+func (r *DynamoDeadLetterRepository) findByIds(ctx context.Context, filter DeadLetterFilter) ([]*DeadLetter, error) {
+	var deadLetters []*DeadLetter
+	for _, id := range filter.Ids {
+		key, err := dynamodbattribute.MarshalMap(map[string]string{"id": id})
+		if err != nil {
+			return nil, err
+		}
+		item, err := r.dynamoClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String(r.tableName), Key: key})
+		if err != nil {
+			return nil, err
+		}
+		if item.Item == nil {
+			continue
+		}
+		var deadLetter DeadLetter
+		if err := dynamodbattribute.UnmarshalMap(item.Item, &deadLetter); err != nil {
+			return nil, err
+		}
+		if filter.matches(&deadLetter) {
+			deadLetters = append(deadLetters, &deadLetter)
+		}
+	}
+	return deadLetters, nil
+}
+
+func dynamoDeadLetterCondition(filter DeadLetterFilter) (expression.ConditionBuilder, bool) {
+	var conditions []expression.ConditionBuilder
+	if filter.Name != "" {
+		conditions = append(conditions, expression.Name("name").Equal(expression.Value(filter.Name)))
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, expression.Name("dead_at").GreaterThanEqual(expression.Value(filter.From.Unix())))
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, expression.Name("dead_at").LessThanEqual(expression.Value(filter.To.Unix())))
+	}
+	switch len(conditions) {
+	case 0:
+		return expression.ConditionBuilder{}, false
+	case 1:
+		return conditions[0], true
+	default:
+		return expression.And(conditions[0], conditions[1], conditions[2:]...), true
+	}
+}
+
+func (r *DynamoDeadLetterRepository) Delete(ctx context.Context, id string) error {
+	key, err := dynamodbattribute.MarshalMap(map[string]string{"id": id})
+	if err != nil {
+		return err
+	}
+	_, err = r.dynamoClient.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{TableName: aws.String(r.tableName), Key: key})
+	return err
+}
+
+func (s *EmitterDeadLetterSink) Send(ctx context.Context, deadLetter *DeadLetter) error {
+	return s.eventEmitter.Emit(ctx, &Event{
+		ID:   deadLetter.Id,
+		Name: DeadLetterEventName,
+		Payload: map[string]string{
+			"id":         deadLetter.Id,
+			"name":       deadLetter.Name,
+			"payload":    deadLetter.Payload,
+			"created_at": deadLetter.CreatedAt.Format(time.RFC3339Nano),
+			"dead_at":    deadLetter.DeadAt.Format(time.RFC3339Nano),
+			"attempts":   strconv.Itoa(deadLetter.Attempts),
+			"last_error": deadLetter.LastError,
+			"emitter":    deadLetter.Emitter,
+		},
+	})
+}
+
+func (sinks DeadLetterSinks) Send(ctx context.Context, deadLetter *DeadLetter) error {
+	var errs []error
+	for _, sink := range sinks {
+		if err := sink.Send(ctx, deadLetter); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultDelayQueueSize bounds how many records a stream keeps waiting for their
+// next attempt.
+const DefaultDelayQueueSize = 1000
+
+type (
+	// delayQueue holds the records that are not due yet, ordered by due time. A record
+	// is kept once: dispatching it again replaces it and moves its due time. Adding
+	// never blocks the stream reader: a full queue drops the record due last, which
+	// the sweeper picks up once it is overdue. Every record leaving the queue without
+	// being handed over is reported to dropped, when set.
+	delayQueue struct {
+		mutex   sync.Mutex
+		items   delayedItems
+		index   map[string]*delayedItem
+		size    int
+		dropped func(outbox *Outbox)
+		wake    chan struct{}
+	}
+
+	delayedItem struct {
+		outbox *Outbox
+		dueAt  time.Time
+		pos    int
+	}
+
+	delayedItems []*delayedItem
+)
+
+func newDelayQueue(size int) *delayQueue {
+	return &delayQueue{
+		index: make(map[string]*delayedItem),
+		size:  size,
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// add schedules a record, replacing the copy of it already waiting, if any.
+func (q *delayQueue) add(outbox *Outbox, dueAt time.Time) {
+	q.mutex.Lock()
+	var dropped *Outbox
+	if item, ok := q.index[outbox.Id]; ok {
+		dropped = item.outbox
+		item.outbox = outbox
+		item.dueAt = dueAt
+		heap.Fix(&q.items, item.pos)
+	} else {
+		if len(q.items) >= q.size {
+			latest := q.items.latest()
+			delayedDropped.Add(1)
+			if !dueAt.Before(latest.dueAt) {
+				q.mutex.Unlock()
+				q.report(outbox)
+				return
+			}
+			heap.Remove(&q.items, latest.pos)
+			delete(q.index, latest.outbox.Id)
+			dropped = latest.outbox
+		} else {
+			delayedDepth.Add(1)
+		}
+		item := &delayedItem{outbox: outbox, dueAt: dueAt}
+		heap.Push(&q.items, item)
+		q.index[outbox.Id] = item
+	}
+	q.mutex.Unlock()
+	q.report(dropped)
+	q.notify()
+}
+
+func (q *delayQueue) report(dropped *Outbox) {
+	if dropped != nil && q.dropped != nil {
+		q.dropped(dropped)
+	}
+}
+
+func (q *delayQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// popDue takes the earliest record out of the queue when it is due, or returns how
+// long it still has to wait. ok is false when the queue is empty.
+func (q *delayQueue) popDue() (outbox *Outbox, wait time.Duration, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.items) == 0 {
+		return nil, 0, false
+	}
+	item := q.items[0]
+	if wait := time.Until(item.dueAt); wait > 0 {
+		return nil, wait, true
+	}
+	heap.Pop(&q.items)
+	delete(q.index, item.outbox.Id)
+	delayedDepth.Add(-1)
+	return item.outbox, 0, true
+}
+
+// remove takes the record waiting under id out of the queue, returning nil when there is none.
+func (q *delayQueue) remove(id string) *Outbox {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	item, ok := q.index[id]
+	if !ok {
+		return nil
+	}
+	heap.Remove(&q.items, item.pos)
+	delete(q.index, id)
+	delayedDepth.Add(-1)
+	return item.outbox
+}
+
+// drop removes the record waiting under id, reporting it as dropped.
+func (q *delayQueue) drop(id string) {
+	q.report(q.remove(id))
+}
+
+// run hands records over through send as they become due, until ctx is done.
+func (q *delayQueue) run(ctx context.Context, send func(outbox *Outbox) bool) {
+	for {
+		outbox, wait, ok := q.popDue()
+		if outbox != nil {
+			if !send(outbox) {
+				return
+			}
+			continue
+		}
+		var timer *time.Timer
+		var due <-chan time.Time
+		if ok {
+			timer = time.NewTimer(wait)
+			due = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-q.wake:
+		case <-due:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (items delayedItems) Len() int { return len(items) }
+
+func (items delayedItems) Less(i, j int) bool { return items[i].dueAt.Before(items[j].dueAt) }
+
+func (items delayedItems) Swap(i, j int) {
+	items[i], items[j] = items[j], items[i]
+	items[i].pos = i
+	items[j].pos = j
+}
+
+func (items *delayedItems) Push(x any) {
+	item := x.(*delayedItem)
+	item.pos = len(*items)
+	*items = append(*items, item)
+}
+
+// latest returns the item due last, which is one of the heap's leaves.
+func (items delayedItems) latest() *delayedItem {
+	latest := items[len(items)/2]
+	for _, item := range items[len(items)/2:] {
+		if item.dueAt.After(latest.dueAt) {
+			latest = item
+		}
+	}
+	return latest
+}
+
+func (items *delayedItems) Pop() any {
+	old := *items
+	item := old[len(old)-1]
+	*items = old[:len(old)-1]
+	return item
+}
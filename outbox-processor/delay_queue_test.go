@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDelayQueueHandsOverInDueOrder(t *testing.T) {
+	queue := newDelayQueue(10)
+	now := time.Now()
+	queue.add(&Outbox{Id: "late"}, now.Add(30*time.Millisecond))
+	queue.add(&Outbox{Id: "early"}, now.Add(10*time.Millisecond))
+	queue.add(&Outbox{Id: "due"}, now.Add(-time.Second))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var sent []string
+	queue.run(ctx, func(outbox *Outbox) bool {
+		sent = append(sent, outbox.Id)
+		return len(sent) < 3
+	})
+
+	if len(sent) != 3 || sent[0] != "due" || sent[1] != "early" || sent[2] != "late" {
+		t.Errorf("sent %v, want [due early late]", sent)
+	}
+}
+
+func TestDelayQueueReplacesParkedCopy(t *testing.T) {
+	var dropped []*Outbox
+	queue := newDelayQueue(10)
+	queue.dropped = func(outbox *Outbox) { dropped = append(dropped, outbox) }
+	first := &Outbox{Id: "1", Version: 1}
+	second := &Outbox{Id: "1", Version: 2}
+	queue.add(first, time.Now().Add(time.Hour))
+	queue.add(second, time.Now().Add(-time.Second))
+
+	outbox, _, _ := queue.popDue()
+	if outbox != second {
+		t.Errorf("popped %v, want the newer copy", outbox)
+	}
+	if len(dropped) != 1 || dropped[0] != first {
+		t.Errorf("dropped %v, want the replaced copy", dropped)
+	}
+	if _, _, ok := queue.popDue(); ok {
+		t.Error("queue still holds a copy")
+	}
+}
+
+func TestDelayQueueWhenFull(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		name    string
+		dueAt   time.Time
+		dropped string
+		kept    []string
+	}{
+		{name: "new record due earlier evicts the latest", dueAt: now.Add(time.Minute), dropped: "3", kept: []string{"1", "new", "2"}},
+		{name: "new record due last is dropped", dueAt: now.Add(time.Hour), dropped: "new", kept: []string{"1", "2", "3"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var dropped []string
+			queue := newDelayQueue(3)
+			queue.dropped = func(outbox *Outbox) { dropped = append(dropped, outbox.Id) }
+			queue.add(&Outbox{Id: "1"}, now.Add(-3*time.Second))
+			queue.add(&Outbox{Id: "2"}, now.Add(2*time.Minute))
+			queue.add(&Outbox{Id: "3"}, now.Add(3*time.Minute))
+
+			done := make(chan struct{})
+			go func() {
+				queue.add(&Outbox{Id: "new"}, test.dueAt)
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("adding to a full queue blocked")
+			}
+
+			if len(dropped) != 1 || dropped[0] != test.dropped {
+				t.Errorf("dropped %v, want [%s]", dropped, test.dropped)
+			}
+			var kept []string
+			for len(queue.items) > 0 {
+				kept = append(kept, queue.remove(queue.items[0].outbox.Id).Id)
+			}
+			if len(kept) != len(test.kept) {
+				t.Fatalf("kept %v, want %v", kept, test.kept)
+			}
+			for i := range kept {
+				if kept[i] != test.kept[i] {
+					t.Fatalf("kept %v, want %v", kept, test.kept)
+				}
+			}
+		})
+	}
+}
+
+func TestDelayQueueDropReportsRecord(t *testing.T) {
+	var dropped []string
+	queue := newDelayQueue(10)
+	queue.dropped = func(outbox *Outbox) { dropped = append(dropped, outbox.Id) }
+	queue.add(&Outbox{Id: "1"}, time.Now().Add(time.Hour))
+
+	queue.drop("1")
+	queue.drop("unknown")
+
+	if len(dropped) != 1 || dropped[0] != "1" {
+		t.Errorf("dropped %v, want [1]", dropped)
+	}
+}
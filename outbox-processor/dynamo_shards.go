@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"log/slog"
+	"time"
+)
+
+const DefaultShardDiscoveryInterval = 30 * time.Second
+
+type (
+	// shardCoordinator owns the shard lifecycle of a DynamoStream. It periodically
+	// re-describes the stream to discover shards created by splits, starts a reader
+	// per shard only once its parent has been drained so records of an item keep
+	// their order, and forgets readers whose shard was closed and fully read.
+	shardCoordinator struct {
+		stream    *DynamoStream
+		streamArn string
+		events    *eventChannel
+		interval  time.Duration
+		shards    map[string]*shardState
+		finished  chan shardResult
+	}
+
+	shardState struct {
+		parentID string
+		running  bool
+		drained  bool
+	}
+
+	shardResult struct {
+		shardID string
+		err     error
+	}
+)
+
+func newShardCoordinator(stream *DynamoStream, streamArn string, events *eventChannel, interval time.Duration) *shardCoordinator {
+	return &shardCoordinator{
+		stream:    stream,
+		streamArn: streamArn,
+		events:    events,
+		interval:  interval,
+		shards:    make(map[string]*shardState),
+		finished:  make(chan shardResult),
+	}
+}
+
+// run coordinates the shards until ctx is done, then waits for the running
+// readers to save their checkpoints and stop.
+func (c *shardCoordinator) run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			c.awaitReaders()
+			return
+		case <-ticker.C:
+			if err := c.discover(ctx); err != nil {
+				if ctx.Err() != nil {
+					continue
+				}
+				slog.Error("Error describing stream shards", "stream", c.streamArn, "error", err)
+				if classifyStreamError(err) == streamErrorFatal {
+					c.stream.fail(err)
+				}
+			}
+		case result := <-c.finished:
+			shard := c.shards[result.shardID]
+			shard.running = false
+			if ctx.Err() != nil {
+				continue
+			}
+			if result.err != nil {
+				slog.Error("Shard reader stopped", "shard", result.shardID, "error", result.err)
+				c.stream.fail(fmt.Errorf("shard %s: %w", result.shardID, result.err))
+				continue
+			}
+			slog.Info("Shard closed and drained", "shard", result.shardID)
+			shard.drained = true
+			c.startReady(ctx)
+		}
+	}
+}
+
+func (c *shardCoordinator) awaitReaders() {
+	for _, shard := range c.shards {
+		if shard.running {
+			<-c.finished
+			shard.running = false
+		}
+	}
+}
+
+// discover lists every shard of the stream, following pagination, registers the
+// ones not seen before and starts those that are ready to be read.
+func (c *shardCoordinator) discover(ctx context.Context) error {
+	input := &dynamodbstreams.DescribeStreamInput{StreamArn: aws.String(c.streamArn)}
+	for {
+		output, err := c.stream.dynamoStreamClient.DescribeStreamWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		for _, shard := range output.StreamDescription.Shards {
+			shardID := aws.StringValue(shard.ShardId)
+			if _, known := c.shards[shardID]; !known {
+				c.shards[shardID] = &shardState{parentID: aws.StringValue(shard.ParentShardId)}
+			}
+		}
+		if output.StreamDescription.LastEvaluatedShardId == nil {
+			break
+		}
+		input.ExclusiveStartShardId = output.StreamDescription.LastEvaluatedShardId
+	}
+	c.startReady(ctx)
+	return nil
+}
+
+func (c *shardCoordinator) startReady(ctx context.Context) {
+	for shardID, shard := range c.shards {
+		if shard.running || shard.drained || !c.parentDrained(shard) {
+			continue
+		}
+		shard.running = true
+		c.events.goTracked(func() {
+			err := c.stream.processShard(ctx, shardID, c.events, c.streamArn)
+			c.finished <- shardResult{shardID: shardID, err: err}
+		})
+	}
+}
+
+// parentDrained reports whether the parent of a shard has been fully read. A parent
+// missing from the stream description was trimmed, so nothing is left to wait for.
+func (c *shardCoordinator) parentDrained(shard *shardState) bool {
+	if shard.parentID == "" {
+		return true
+	}
+	parent, known := c.shards[shard.parentID]
+	return !known || parent.drained
+}
@@ -1,32 +1,50 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"log/slog"
 	"time"
 )
 
+// DynamoStream reads the table's stream, checkpointing each shard past the records
+// it has handed over. Recovering records handed over but never handled, e.g. on a
+// crash, is left to the sweeper rather than replaying the shard.
 type DynamoStream struct {
 	dynamoStreamClient *dynamodbstreams.DynamoDBStreams
 	awsSession         *session.Session
 	tableName          string
 	dynamoDB           *dynamodb.DynamoDB
+	checkpoints        CheckpointStore
+	outboxRepository   OutboxRepository
+	errors             chan error
+
+	shardDiscoveryInterval time.Duration
 }
 
-func NewDynamoStream(awsSession *session.Session, tableName string, dynamoDB *dynamodb.DynamoDB) OutboxStream {
+func NewDynamoStream(awsSession *session.Session, tableName string, dynamoDB *dynamodb.DynamoDB, checkpoints CheckpointStore) OutboxStream {
 	return &DynamoStream{
 		dynamoStreamClient: dynamodbstreams.New(awsSession),
 		dynamoDB:           dynamoDB,
 		awsSession:         awsSession,
 		tableName:          tableName,
+		checkpoints:        checkpoints,
+		outboxRepository:   NewDynamoOutboxRepository(dynamoDB, tableName),
+		errors:             make(chan error, 1),
+
+		shardDiscoveryInterval: DefaultShardDiscoveryInterval,
 	}
 }
 
-func (stream *DynamoStream) getStreamArn() (string, error) {
-	result, err := stream.dynamoDB.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(stream.tableName)})
+func (stream *DynamoStream) getStreamArn(ctx context.Context) (string, error) {
+	result, err := stream.dynamoDB.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(stream.tableName)})
 	if err != nil {
 		return "", err
 	}
@@ -36,61 +54,115 @@ func (stream *DynamoStream) getStreamArn() (string, error) {
 	return "", fmt.Errorf("streams not enabled for table %s", stream.tableName)
 }
 
-func (stream *DynamoStream) FetchEvents() (chan string, error) {
-	streamArn, err := stream.getStreamArn()
+func (stream *DynamoStream) FetchEvents(ctx context.Context) (chan *Outbox, error) {
+	streamArn, err := stream.getStreamArn(ctx)
 	if err != nil {
 		return nil, err
 	}
-	events := make(chan string)
-	describeStreamInput := &dynamodbstreams.DescribeStreamInput{StreamArn: aws.String(streamArn)}
-	describeStreamOutput, err := stream.dynamoStreamClient.DescribeStream(describeStreamInput)
-	if err != nil {
+	events := newEventChannel(ctx)
+	coordinator := newShardCoordinator(stream, streamArn, events, stream.shardDiscoveryInterval)
+	if err := coordinator.discover(ctx); err != nil {
 		return nil, err
 	}
-	for _, shard := range describeStreamOutput.StreamDescription.Shards {
-		go stream.processShard(*shard.ShardId, events, streamArn)
-	}
-	return events, nil
+	events.goTracked(func() { coordinator.run(ctx) })
+	events.closeWhenDone()
+	return events.events, nil
 }
 
-func (stream *DynamoStream) processShard(shardID string, events chan<- string, streamArn string) {
-	shardIteratorInput := &dynamodbstreams.GetShardIteratorInput{
-		StreamArn:         aws.String(streamArn),
-		ShardId:           aws.String(shardID),
-		ShardIteratorType: aws.String(dynamodbstreams.ShardIteratorTypeTrimHorizon),
-	}
+func (stream *DynamoStream) Errors() <-chan error {
+	return stream.errors
+}
 
-	shardIteratorOutput, err := stream.dynamoStreamClient.GetShardIterator(shardIteratorInput)
-	if err != nil {
-		return
+// fail reports an error the stream cannot recover from to the caller. Only the
+// first one is kept, as the caller is expected to stop the stream on it.
+func (stream *DynamoStream) fail(err error) {
+	select {
+	case stream.errors <- err:
+	default:
 	}
+}
 
-	ShardIterator := shardIteratorOutput.ShardIterator
+// processShard reads a shard until it is closed and drained, which is when
+// GetRecords stops returning a next iterator, or until ctx is done. Transient
+// failures are retried here; only errors the reader cannot recover from, or
+// the context error when stopped, are returned.
+func (stream *DynamoStream) processShard(ctx context.Context, shardID string, events *eventChannel, streamArn string) error {
 	backoff := time.Second
+	var lastSequence string
+	ShardIterator, err := stream.openShard(ctx, streamArn, shardID)
+	if err != nil {
+		return err
+	}
 
-	for {
+	for ShardIterator != nil {
 		getRecordsInput := &dynamodbstreams.GetRecordsInput{ShardIterator: ShardIterator}
-		records, err := stream.dynamoStreamClient.GetRecords(getRecordsInput)
+		records, err := stream.dynamoStreamClient.GetRecordsWithContext(ctx, getRecordsInput)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
+			switch classifyStreamError(err) {
+			case streamErrorReopen:
+				slog.Warn("Shard iterator is no longer valid, reopening it from the last checkpoint", "shard", shardID, "sequence", lastSequence, "error", err)
+				if ShardIterator, err = stream.openShard(ctx, streamArn, shardID); err != nil {
+					return err
+				}
+			case streamErrorThrottled:
+				slog.Warn("Reading shard is throttled, backing off", "shard", shardID, "sequence", lastSequence, "backoff", backoff, "error", err)
+				if !sleep(ctx, backoff) {
+					return ctx.Err()
+				}
+				backoff = min(backoff*2, 30*time.Second)
+			case streamErrorFatal:
+				slog.Error("Error reading shard", "shard", shardID, "sequence", lastSequence, "error", err)
+				return err
+			default:
+				slog.Error("Error reading shard, retrying", "shard", shardID, "sequence", lastSequence, "backoff", backoff, "error", err)
+				if !sleep(ctx, backoff) {
+					return ctx.Err()
+				}
+				backoff = min(backoff*2, 30*time.Second)
+			}
 			continue
 		}
 
+		delivered := ""
 		for _, record := range records.Records {
-			id := record.Dynamodb.NewImage["id"].S
-			status := record.Dynamodb.NewImage["status"].S
-			if *record.EventName == "INSERT" {
-				backoff = time.Second
-				events <- *id
-			} else if *record.EventName == "MODIFY" && *status == "ERROR" {
+			if *record.EventName != "INSERT" && *record.EventName != "MODIFY" {
+				delivered = aws.StringValue(record.Dynamodb.SequenceNumber)
+				continue
+			}
+			outbox, err := stream.decodeRecord(ctx, record)
+			if err != nil {
+				slog.Error("Error decoding stream record", "shard", shardID, "sequence", aws.StringValue(record.Dynamodb.SequenceNumber), "error", err)
+			} else if outbox != nil {
+				// Images of live claims or finished records only drop a parked copy of the record.
 				backoff = time.Second
-				go func(id string) {
-					time.Sleep(5 * time.Second)
-					events <- id
-				}(*id)
+				if !events.dispatch(outbox) {
+					break
+				}
+			}
+			delivered = aws.StringValue(record.Dynamodb.SequenceNumber)
+		}
+		if delivered != "" {
+			lastSequence = delivered
+			// Saved even while stopping, so the checkpoint covers every record handed over.
+			// A record lost with a crash before it was handled stays PENDING or ERROR in the
+			// table, where the sweeper picks it up again.
+			if err := stream.checkpoints.Save(context.WithoutCancel(ctx), shardID, lastSequence); err != nil {
+				slog.Error("Error saving shard checkpoint", "shard", shardID, "sequence", lastSequence, "error", err)
 			}
 		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		ShardIterator = records.NextShardIterator
-		time.Sleep(backoff)
+		if ShardIterator == nil {
+			break
+		}
+		if !sleep(ctx, backoff) {
+			return ctx.Err()
+		}
 
 		if backoff < 30*time.Second {
 			backoff *= 2
@@ -98,4 +170,108 @@ func (stream *DynamoStream) processShard(shardID string, events chan<- string, s
 			backoff = 30 * time.Second
 		}
 	}
+	return nil
+}
+
+// decodeRecord returns the record from the new image of a stream record. Only when
+// the stream carries no image, e.g. when its view type is KEYS_ONLY, is the record
+// read from the table; it is nil when the record no longer exists.
+func (stream *DynamoStream) decodeRecord(ctx context.Context, record *dynamodbstreams.Record) (*Outbox, error) {
+	if len(record.Dynamodb.NewImage) == 0 {
+		var key struct {
+			Id string `json:"id"`
+		}
+		if err := dynamodbattribute.UnmarshalMap(record.Dynamodb.Keys, &key); err != nil {
+			return nil, err
+		}
+		return stream.outboxRepository.Get(ctx, key.Id)
+	}
+	var outbox Outbox
+	if err := dynamodbattribute.UnmarshalMap(record.Dynamodb.NewImage, &outbox); err != nil {
+		return nil, err
+	}
+	return &outbox, nil
+}
+
+// openShard opens an iterator on a shard, retrying transient failures with backoff.
+func (stream *DynamoStream) openShard(ctx context.Context, streamArn, shardID string) (*string, error) {
+	backoff := time.Second
+	for {
+		iterator, err := stream.shardIterator(ctx, streamArn, shardID)
+		if err == nil {
+			return iterator, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if classifyStreamError(err) == streamErrorFatal {
+			slog.Error("Error opening shard iterator", "shard", shardID, "error", err)
+			return nil, err
+		}
+		slog.Warn("Error opening shard iterator, retrying", "shard", shardID, "backoff", backoff, "error", err)
+		if !sleep(ctx, backoff) {
+			return nil, ctx.Err()
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// shardIterator opens a shard right after its last checkpointed record, or at the
+// trim horizon for shards never seen before or whose checkpoint has been trimmed.
+func (stream *DynamoStream) shardIterator(ctx context.Context, streamArn, shardID string) (*string, error) {
+	sequenceNumber, err := stream.checkpoints.Get(ctx, shardID)
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(streamArn),
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: aws.String(dynamodbstreams.ShardIteratorTypeTrimHorizon),
+	}
+	if sequenceNumber != "" {
+		input.ShardIteratorType = aws.String(dynamodbstreams.ShardIteratorTypeAfterSequenceNumber)
+		input.SequenceNumber = aws.String(sequenceNumber)
+	}
+	output, err := stream.dynamoStreamClient.GetShardIteratorWithContext(ctx, input)
+	var awsErr awserr.Error
+	if sequenceNumber != "" && errors.As(err, &awsErr) && awsErr.Code() == dynamodbstreams.ErrCodeTrimmedDataAccessException {
+		slog.Warn("Shard checkpoint was trimmed from the stream, resuming from trim horizon", "shard", shardID, "sequence", sequenceNumber)
+		input.ShardIteratorType = aws.String(dynamodbstreams.ShardIteratorTypeTrimHorizon)
+		input.SequenceNumber = nil
+		output, err = stream.dynamoStreamClient.GetShardIteratorWithContext(ctx, input)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return output.ShardIterator, nil
+}
+
+type streamErrorKind int
+
+const (
+	streamErrorTransient streamErrorKind = iota
+	streamErrorReopen
+	streamErrorThrottled
+	streamErrorFatal
+)
+
+// classifyStreamError tells how a shard reader recovers from a stream API error:
+// expired or trimmed iterators are reopened from the checkpoint, throttling is
+// backed off, errors about the stream itself or the request are fatal and any
+// other error (e.g. network) is retried.
+func classifyStreamError(err error) streamErrorKind {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return streamErrorTransient
+	}
+	switch awsErr.Code() {
+	case dynamodbstreams.ErrCodeExpiredIteratorException, dynamodbstreams.ErrCodeTrimmedDataAccessException:
+		return streamErrorReopen
+	case dynamodbstreams.ErrCodeLimitExceededException, "ThrottlingException", "ProvisionedThroughputExceededException":
+		return streamErrorThrottled
+	case dynamodbstreams.ErrCodeResourceNotFoundException, "AccessDeniedException", "UnrecognizedClientException", "ValidationException":
+		return streamErrorFatal
+	default:
+		return streamErrorTransient
+	}
 }
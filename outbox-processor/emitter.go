@@ -1,11 +1,42 @@
 package main
 
+import (
+	"context"
+	"time"
+)
+
 type Event struct {
 	ID      string            `json:"id,omitempty" bson:"id,omitempty"`
 	Name    string            `json:"name,omitempty" bson:"name,omitempty"`
 	Payload map[string]string `json:"payload,omitempty" bson:"payload,omitempty"`
+	// CreatedAt and Headers come from the outbox record rather than the payload, and
+	// are sent as message metadata by emitters that support it.
+	CreatedAt time.Time         `json:"-" bson:"-"`
+	Headers   map[string]string `json:"-" bson:"-"`
 }
 
 type EventEmitter interface {
-	Emit(event *Event) error
+	Emit(ctx context.Context, event *Event) error
+	Name() string
+	Close() error
+}
+
+// BatchEmitter is implemented by emitters that can send several events in one go.
+type BatchEmitter interface {
+	EventEmitter
+	// EmitBatch emits the events and returns one result per event, in the same
+	// order, nil for those the broker accepted.
+	EmitBatch(ctx context.Context, events []*Event) []error
+}
+
+// emitAll emits the events with EmitBatch when the emitter supports it, and one by one otherwise.
+func emitAll(ctx context.Context, emitter EventEmitter, events []*Event) []error {
+	if batchEmitter, ok := emitter.(BatchEmitter); ok && len(events) > 1 {
+		return batchEmitter.EmitBatch(ctx, events)
+	}
+	errs := make([]error, len(events))
+	for i, event := range events {
+		errs[i] = emitter.Emit(ctx, event)
+	}
+	return errs
 }
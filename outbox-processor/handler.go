@@ -1,36 +1,199 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"log/slog"
+	"time"
 )
 
+// maxUpdateAttempts bounds how many times a transition is re-applied on a fresh
+// copy of a record that keeps being modified concurrently.
+const maxUpdateAttempts = 3
+
 type OutboxHandler struct {
 	outboxRepository OutboxRepository
 	eventEmitter     EventEmitter
+	retryPolicy      RetryPolicy
+	deadLetterSink   DeadLetterSink
+	ordering         OrderingPolicy
+}
+
+func NewOutboxHandler(outboxRepository OutboxRepository, eventEmitter EventEmitter, retryPolicy RetryPolicy, deadLetterSink DeadLetterSink, ordering OrderingPolicy) *OutboxHandler {
+	return &OutboxHandler{
+		outboxRepository: outboxRepository,
+		eventEmitter:     eventEmitter,
+		retryPolicy:      retryPolicy,
+		deadLetterSink:   deadLetterSink,
+		ordering:         ordering,
+	}
+}
+
+func (handler OutboxHandler) Handle(ctx context.Context, outbox *Outbox) {
+	handler.HandleBatch(ctx, []*Outbox{outbox})
+}
+
+// HandleBatch emits the records together, through EmitBatch when the emitter supports
+// it, and persists their new statuses in bulk. Ordered records sharing a key are handled
+// in successive rounds, so each one sees the outcome of the one before it.
+func (handler OutboxHandler) HandleBatch(ctx context.Context, outboxes []*Outbox) {
+	for len(outboxes) > 0 {
+		var round []*Outbox
+		round, outboxes = handler.nextRound(outboxes)
+		handler.handleRound(ctx, round)
+	}
 }
 
-func NewOutboxHandler(outboxRepository OutboxRepository, eventEmitter EventEmitter) *OutboxHandler {
-	return &OutboxHandler{outboxRepository: outboxRepository, eventEmitter: eventEmitter}
+// nextRound takes the first record of every ordering key, along with all unordered
+// records, and returns the rest for later rounds.
+func (handler OutboxHandler) nextRound(outboxes []*Outbox) (round, rest []*Outbox) {
+	keys := make(map[string]bool)
+	for _, outbox := range outboxes {
+		if outbox != nil && handler.ordering.Ordered(outbox) {
+			if keys[outbox.OrderingKey] {
+				rest = append(rest, outbox)
+				continue
+			}
+			keys[outbox.OrderingKey] = true
+		}
+		round = append(round, outbox)
+	}
+	return round, rest
 }
 
-func (handler OutboxHandler) Handle(outbox *Outbox) {
-	if outbox == nil || outbox.Status == "PROCESSED" {
+func (handler OutboxHandler) handleRound(ctx context.Context, outboxes []*Outbox) {
+	var ready []*Outbox
+	var events []*Event
+	for _, outbox := range outboxes {
+		if outbox == nil || outbox.IsFinished() {
+			continue
+		}
+		if handler.waitsForEarlier(ctx, outbox) {
+			continue
+		}
+		messageEvent, err := outbox.event()
+		if err != nil {
+			// A payload that cannot be decoded will never succeed, so retrying it only burns attempts.
+			slog.Error("Error unmarshalling message event: "+err.Error(), "id", outbox.Id)
+			handler.transition(ctx, outbox, func(o *Outbox) { o.MarkAsDead(err) })
+			continue
+		}
+		ready = append(ready, outbox)
+		events = append(events, messageEvent)
+	}
+	if len(ready) == 0 {
 		return
 	}
-	var messageEvent Event
-	err := json.Unmarshal([]byte(outbox.Payload), &messageEvent)
+	errs := emitAll(ctx, handler.eventEmitter, events)
+	applies := make([]func(*Outbox), len(ready))
+	for i, err := range errs {
+		if err != nil {
+			slog.Error("Error emitting outbox event", "id", ready[i].Id, "attempts", ready[i].Attempts+1, "error", err)
+			applies[i] = func(o *Outbox) { o.MarkAsError(handler.retryPolicy, err) }
+		} else {
+			applies[i] = (*Outbox).MarkAsProcessed
+		}
+	}
+	handler.transitionAll(ctx, ready, applies)
+}
+
+// waitsForEarlier postpones an ordered record while an earlier record of its key is
+// not finished, so a record in retry holds back the ones created after it. A dead
+// record does not, since it would otherwise block its key until redriven.
+func (handler OutboxHandler) waitsForEarlier(ctx context.Context, outbox *Outbox) bool {
+	if !handler.ordering.Ordered(outbox) {
+		return false
+	}
+	earlier, err := handler.outboxRepository.FindUnfinishedBefore(ctx, outbox)
 	if err != nil {
-		_ = handler.outboxRepository.Update(outbox)
-		slog.Error("Error unmarshalling message event: " + err.Error())
+		slog.Error("Error looking up earlier outbox records", "id", outbox.Id, "ordering_key", outbox.OrderingKey, "error", err)
+	} else if earlier == nil {
+		return false
+	} else {
+		slog.Debug("Postponing outbox record behind an earlier one", "id", outbox.Id, "earlier", earlier.Id, "ordering_key", outbox.OrderingKey)
+	}
+	until := time.Now().Add(handler.ordering.RecheckDelay)
+	if earlier != nil && earlier.NextAttemptAt != nil && earlier.NextAttemptAt.After(until) {
+		until = *earlier.NextAttemptAt
+	}
+	handler.transition(ctx, outbox, func(o *Outbox) { o.Postpone(until) })
+	return true
+}
+
+// transition applies apply to the record and persists it. When the record was modified
+// concurrently it is re-read instead of overwritten: if it is finished or no longer held
+// by the claim this handler works under, the other writer wins; otherwise apply is
+// replayed on the fresh copy.
+func (handler OutboxHandler) transition(ctx context.Context, outbox *Outbox, apply func(*Outbox)) {
+	handler.transitionAll(ctx, []*Outbox{outbox}, []func(*Outbox){apply})
+}
+
+// transitionAll is transition for several records, persisted with a single UpdateBatch.
+// Records that were modified concurrently are then retried one at a time. Records
+// that end up DEAD are dead-lettered once their status is persisted.
+func (handler OutboxHandler) transitionAll(ctx context.Context, outboxes []*Outbox, applies []func(*Outbox)) {
+	owners := make([]string, len(outboxes))
+	for i, outbox := range outboxes {
+		owners[i] = outbox.Owner
+		applies[i](outbox)
+	}
+	var errs []error
+	if len(outboxes) == 1 {
+		errs = []error{handler.outboxRepository.Update(ctx, outboxes[0])}
+	} else {
+		errs = handler.outboxRepository.UpdateBatch(ctx, outboxes)
+	}
+	for i, err := range errs {
+		if err != nil && !handler.retryTransition(ctx, outboxes[i], applies[i], owners[i], err) {
+			continue
+		}
+		if outboxes[i].Status == OutboxStatusDead {
+			handler.deadLetter(ctx, outboxes[i])
+		}
+	}
+}
+
+// retryTransition replays apply on fresh copies of a concurrently modified record,
+// reporting whether the transition was eventually persisted.
+func (handler OutboxHandler) retryTransition(ctx context.Context, outbox *Outbox, apply func(*Outbox), owner string, err error) bool {
+	for attempt := 2; ; attempt++ {
+		if !errors.Is(err, ErrConcurrentModification) || attempt > maxUpdateAttempts {
+			slog.Error("Error updating outbox record", "id", outbox.Id, "status", outbox.Status, "error", err)
+			return false
+		}
+		current, getErr := handler.outboxRepository.Get(ctx, outbox.Id)
+		if getErr != nil {
+			slog.Error("Error re-reading concurrently modified outbox record", "id", outbox.Id, "error", getErr)
+			return false
+		}
+		if current == nil || current.IsFinished() || current.Status != OutboxStatusInProgress || current.Owner != owner {
+			slog.Warn("Outbox record was taken over by another writer, dropping update", "id", outbox.Id)
+			return false
+		}
+		*outbox = *current
+		apply(outbox)
+		err = handler.outboxRepository.Update(ctx, outbox)
+		if err == nil {
+			return true
+		}
+	}
+}
+
+// deadLetter sends a record whose DEAD status has been persisted to the dead-letter
+// sink, once, however many times the transition was replayed. When the sink is
+// unavailable the record is moved back to ERROR so it comes back and is dead-lettered
+// again later, instead of staying DEAD without a visible trace.
+func (handler OutboxHandler) deadLetter(ctx context.Context, outbox *Outbox) {
+	if handler.deadLetterSink == nil {
 		return
 	}
-	err = handler.eventEmitter.Emit(&messageEvent)
-	if err != nil {
-		outbox.MarkAsError()
-		_ = handler.outboxRepository.Update(outbox)
+	err := handler.deadLetterSink.Send(ctx, NewDeadLetter(outbox, handler.eventEmitter.Name()))
+	if err == nil {
 		return
 	}
-	outbox.MarkAsProcessed()
-	_ = handler.outboxRepository.Update(outbox)
+	slog.Error("Error sending outbox record to dead letter", "id", outbox.Id, "error", err)
+	outbox.scheduleNextAttempt(time.Now(), handler.retryPolicy)
+	if err := handler.outboxRepository.Update(ctx, outbox); err != nil {
+		slog.Error("Error returning outbox record to retry after dead letter failure", "id", outbox.Id, "error", err)
+	}
 }
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryOutboxRepository keeps records in memory with Update's version check.
+type memoryOutboxRepository struct {
+	mutex   sync.Mutex
+	records map[string]*Outbox
+	// conflicts is how many more updates of a record race with another writer that
+	// renews the claim first, bumping the stored version.
+	conflicts map[string]int
+	// failures are returned by the next updates of a record instead of writing it.
+	failures map[string][]error
+}
+
+func newMemoryOutboxRepository(outboxes ...*Outbox) *memoryOutboxRepository {
+	r := &memoryOutboxRepository{records: map[string]*Outbox{}, conflicts: map[string]int{}, failures: map[string][]error{}}
+	for _, outbox := range outboxes {
+		stored := *outbox
+		r.records[outbox.Id] = &stored
+	}
+	return r
+}
+
+func (r *memoryOutboxRepository) Update(_ context.Context, outbox *Outbox) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if failures := r.failures[outbox.Id]; len(failures) > 0 {
+		r.failures[outbox.Id] = failures[1:]
+		return failures[0]
+	}
+	stored, ok := r.records[outbox.Id]
+	if ok && r.conflicts[outbox.Id] > 0 {
+		r.conflicts[outbox.Id]--
+		stored.Version++
+	}
+	if !ok || stored.Version != outbox.Version {
+		return ErrConcurrentModification
+	}
+	outbox.Version++
+	updated := *outbox
+	r.records[outbox.Id] = &updated
+	return nil
+}
+
+func (r *memoryOutboxRepository) UpdateBatch(ctx context.Context, outboxes []*Outbox) []error {
+	errs := make([]error, len(outboxes))
+	for i, outbox := range outboxes {
+		errs[i] = r.Update(ctx, outbox)
+	}
+	return errs
+}
+
+func (r *memoryOutboxRepository) Get(_ context.Context, id string) (*Outbox, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	stored, ok := r.records[id]
+	if !ok {
+		return nil, nil
+	}
+	outbox := *stored
+	return &outbox, nil
+}
+
+func (r *memoryOutboxRepository) Claim(_ context.Context, outbox *Outbox, owner string, lease time.Duration) (*Outbox, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	stored, ok := r.records[outbox.Id]
+	if !ok || stored.Version != outbox.Version || !stored.IsClaimable(now) {
+		return nil, nil
+	}
+	claimed := outbox.claimedBy(owner, now.Add(lease))
+	updated := *claimed
+	r.records[outbox.Id] = &updated
+	return claimed, nil
+}
+
+func (r *memoryOutboxRepository) FindStuck(context.Context, time.Time, int) ([]*Outbox, error) {
+	return nil, nil
+}
+
+func (r *memoryOutboxRepository) FindUnfinishedBefore(_ context.Context, outbox *Outbox) (*Outbox, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var earliest *Outbox
+	for _, stored := range r.records {
+		if stored.OrderingKey != outbox.OrderingKey || !stored.CreatedAt.Before(outbox.CreatedAt) || stored.IsFinished() {
+			continue
+		}
+		if earliest == nil || stored.CreatedAt.Before(earliest.CreatedAt) {
+			earliest = stored
+		}
+	}
+	if earliest == nil {
+		return nil, nil
+	}
+	found := *earliest
+	return &found, nil
+}
+
+func (r *memoryOutboxRepository) stored(id string) *Outbox {
+	outbox, _ := r.Get(context.Background(), id)
+	return outbox
+}
+
+// recordingEmitter fails the events whose id is in failures and records the others.
+type recordingEmitter struct {
+	mutex    sync.Mutex
+	failures map[string]error
+	emitted  []*Event
+}
+
+func (e *recordingEmitter) Emit(_ context.Context, event *Event) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.failures[event.ID]; err != nil {
+		return err
+	}
+	e.emitted = append(e.emitted, event)
+	return nil
+}
+
+func (e *recordingEmitter) Name() string {
+	return "recording"
+}
+
+func (e *recordingEmitter) Close() error {
+	return nil
+}
+
+type recordingDeadLetterSink struct {
+	err  error
+	sent []*DeadLetter
+}
+
+func (s *recordingDeadLetterSink) Send(_ context.Context, deadLetter *DeadLetter) error {
+	s.sent = append(s.sent, deadLetter)
+	return s.err
+}
+
+func claimedOutbox(id string, attempts int) *Outbox {
+	lease := time.Now().Add(time.Minute)
+	return &Outbox{
+		Id:             id,
+		Name:           "PAYMENT_PROCESSED",
+		Payload:        `{"id":"` + id + `","name":"PAYMENT_PROCESSED"}`,
+		Status:         OutboxStatusInProgress,
+		CreatedAt:      time.Now(),
+		Attempts:       attempts,
+		Owner:          "replica",
+		LeaseExpiresAt: &lease,
+		Version:        1,
+	}
+}
+
+func newTestHandler(repository OutboxRepository, emitter EventEmitter, sink DeadLetterSink) OutboxHandler {
+	policy := RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Minute, MaxBackoff: time.Hour}
+	return *NewOutboxHandler(repository, emitter, policy, sink, DefaultOrderingPolicy())
+}
+
+func TestHandlerOutcomes(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		attempts    int
+		emitErr     error
+		status      string
+		deadLetters int
+	}{
+		{name: "emitted", status: OutboxStatusProcessed},
+		{name: "failed within budget", attempts: 1, emitErr: errors.New("unavailable"), status: OutboxStatusError},
+		{name: "failed last attempt", attempts: 2, emitErr: errors.New("unavailable"), status: OutboxStatusDead, deadLetters: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			outbox := claimedOutbox("1", test.attempts)
+			repository := newMemoryOutboxRepository(outbox)
+			sink := &recordingDeadLetterSink{}
+			emitter := &recordingEmitter{failures: map[string]error{"1": test.emitErr}}
+
+			newTestHandler(repository, emitter, sink).Handle(context.Background(), outbox)
+
+			if stored := repository.stored("1"); stored.Status != test.status || stored.Version != 2 {
+				t.Errorf("stored status %s at version %d, want %s at version 2", stored.Status, stored.Version, test.status)
+			}
+			if len(sink.sent) != test.deadLetters {
+				t.Errorf("sent %d dead letters, want %d", len(sink.sent), test.deadLetters)
+			}
+		})
+	}
+}
+
+func TestHandlerUndecodablePayloadIsDeadLettered(t *testing.T) {
+	outbox := claimedOutbox("1", 0)
+	outbox.Payload = "{"
+	repository := newMemoryOutboxRepository(outbox)
+	sink := &recordingDeadLetterSink{}
+	emitter := &recordingEmitter{}
+
+	newTestHandler(repository, emitter, sink).Handle(context.Background(), outbox)
+
+	if stored := repository.stored("1"); stored.Status != OutboxStatusDead {
+		t.Errorf("stored status = %s, want %s", stored.Status, OutboxStatusDead)
+	}
+	if len(emitter.emitted) != 0 || len(sink.sent) != 1 {
+		t.Errorf("emitted %d events and %d dead letters, want none and one", len(emitter.emitted), len(sink.sent))
+	}
+}
+
+func TestRetryTransition(t *testing.T) {
+	markDead := func(o *Outbox) { o.MarkAsDead(errors.New("poison")) }
+	for _, test := range []struct {
+		name string
+		// change is applied to the stored record before the retry re-reads it.
+		change    func(*Outbox)
+		conflicts int
+		err       error
+		persisted bool
+	}{
+		{name: "claim renewed by the owner", change: func(o *Outbox) { o.Version++ }, persisted: true},
+		{name: "claim renewed until the attempts run out", change: func(o *Outbox) { o.Version++ }, conflicts: maxUpdateAttempts, persisted: false},
+		{name: "claimed by another replica", change: func(o *Outbox) { o.Owner = "other"; o.Version++ }},
+		{name: "finished by another writer", change: func(o *Outbox) { o.MarkAsProcessed(); o.Version++ }},
+		{name: "released by another writer", change: func(o *Outbox) { o.Postpone(time.Now()); o.Version++ }},
+		{name: "not a concurrent modification", err: errors.New("connection reset")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			outbox := claimedOutbox("1", 0)
+			repository := newMemoryOutboxRepository(outbox)
+			if test.change != nil {
+				test.change(repository.records["1"])
+			}
+			repository.conflicts["1"] = test.conflicts
+			before := *repository.stored("1")
+			err := test.err
+			if err == nil {
+				err = ErrConcurrentModification
+			}
+
+			markDead(outbox)
+			persisted := newTestHandler(repository, &recordingEmitter{}, nil).retryTransition(context.Background(), outbox, markDead, "replica", err)
+
+			if persisted != test.persisted {
+				t.Fatalf("persisted = %v, want %v", persisted, test.persisted)
+			}
+			stored := repository.stored("1")
+			if persisted && stored.Status != OutboxStatusDead {
+				t.Errorf("stored status = %s, want %s", stored.Status, OutboxStatusDead)
+			}
+			if !persisted && test.conflicts == 0 && (stored.Status != before.Status || stored.Owner != before.Owner) {
+				t.Errorf("stored record changed to %s owned by %q", stored.Status, stored.Owner)
+			}
+		})
+	}
+}
+
+func TestHandlerDeadLettersOnceAfterReplayingTransition(t *testing.T) {
+	outbox := claimedOutbox("1", 2)
+	repository := newMemoryOutboxRepository(outbox)
+	repository.conflicts["1"] = 1
+	sink := &recordingDeadLetterSink{}
+	emitter := &recordingEmitter{failures: map[string]error{"1": errors.New("unavailable")}}
+
+	newTestHandler(repository, emitter, sink).Handle(context.Background(), outbox)
+
+	if stored := repository.stored("1"); stored.Status != OutboxStatusDead {
+		t.Errorf("stored status = %s, want %s", stored.Status, OutboxStatusDead)
+	}
+	if len(sink.sent) != 1 || sink.sent[0].Id != "1" || sink.sent[0].Attempts != 3 {
+		t.Errorf("dead letters = %v, want one for record 1 after 3 attempts", sink.sent)
+	}
+}
+
+func TestHandlerDoesNotDeadLetterUnpersistedDeath(t *testing.T) {
+	outbox := claimedOutbox("1", 2)
+	repository := newMemoryOutboxRepository(outbox)
+	repository.failures["1"] = []error{errors.New("connection reset")}
+	sink := &recordingDeadLetterSink{}
+	emitter := &recordingEmitter{failures: map[string]error{"1": errors.New("unavailable")}}
+
+	newTestHandler(repository, emitter, sink).Handle(context.Background(), outbox)
+
+	if stored := repository.stored("1"); stored.Status != OutboxStatusInProgress {
+		t.Errorf("stored status = %s, want it left %s", stored.Status, OutboxStatusInProgress)
+	}
+	if len(sink.sent) != 0 {
+		t.Errorf("sent %d dead letters for a record that is not DEAD", len(sink.sent))
+	}
+}
+
+func TestDeadLetterSinkFailureReturnsRecordToRetry(t *testing.T) {
+	outbox := claimedOutbox("1", 2)
+	repository := newMemoryOutboxRepository(outbox)
+	sink := &recordingDeadLetterSink{err: errors.New("dead letter table unavailable")}
+	emitter := &recordingEmitter{failures: map[string]error{"1": errors.New("unavailable")}}
+
+	newTestHandler(repository, emitter, sink).Handle(context.Background(), outbox)
+
+	stored := repository.stored("1")
+	if stored.Status != OutboxStatusError || stored.NextAttemptAt == nil {
+		t.Errorf("stored status %s with next attempt at %v, want %s with a next attempt", stored.Status, stored.NextAttemptAt, OutboxStatusError)
+	}
+	if len(sink.sent) != 1 {
+		t.Errorf("sent %d dead letters, want 1", len(sink.sent))
+	}
+}
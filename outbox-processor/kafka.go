@@ -2,35 +2,170 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
 	"log/slog"
+	"time"
 )
 
+const (
+	KafkaSaslPlain       = "PLAIN"
+	KafkaSaslScramSha256 = "SCRAM-SHA-256"
+	KafkaSaslScramSha512 = "SCRAM-SHA-512"
+)
+
+// KafkaRouting decides which topic an event is written to and which key it is
+// partitioned by. Events are written to the topic mapped to their name in Topics,
+// else to DefaultTopic, else to a topic named after the event, always prefixed by
+// TopicPrefix. PartitionKey names a payload field, such as purchaseId, whose value
+// keys the message so related events land on the same partition; the event id is
+// used when it is not set or the field is missing.
+type KafkaRouting struct {
+	Topics       map[string]string
+	DefaultTopic string
+	TopicPrefix  string
+	PartitionKey string
+}
+
+// KafkaSecurity holds how the Kafka emitters connect to the brokers: TLS, possibly
+// with a client certificate, and SASL authentication with one of the KafkaSasl
+// mechanisms. The zero value connects in plaintext without authentication.
+type KafkaSecurity struct {
+	TLS           *tls.Config
+	SaslMechanism string
+	Username      string
+	Password      string
+}
+
 type KafkaEventEmitter struct {
-	writer *kafka.Writer
+	writer  *kafka.Writer
+	routing KafkaRouting
 }
 
-func NewKafkaEventEmitter(brokers []string, topic string) *KafkaEventEmitter {
+func NewKafkaEventEmitter(brokers []string, routing KafkaRouting, security KafkaSecurity) (*KafkaEventEmitter, error) {
+	mechanism, err := security.mechanism()
+	if err != nil {
+		return nil, err
+	}
 	return &KafkaEventEmitter{
+		// The topic is set per message, which kafka-go requires the writer to leave unset.
+		// Messages are spread by key so a partition key keeps its events in one partition.
 		writer: &kafka.Writer{
-			Addr:     kafka.TCP(brokers...),
-			Topic:    topic,
-			Balancer: &kafka.LeastBytes{},
+			Addr:      kafka.TCP(brokers...),
+			Balancer:  &kafka.Hash{},
+			Transport: &kafka.Transport{TLS: security.TLS, SASL: mechanism},
 		},
+		routing: routing,
+	}, nil
+}
+
+func (s KafkaSecurity) mechanism() (sasl.Mechanism, error) {
+	switch s.SaslMechanism {
+	case "":
+		return nil, nil
+	case KafkaSaslPlain:
+		return plain.Mechanism{Username: s.Username, Password: s.Password}, nil
+	case KafkaSaslScramSha256:
+		return scram.Mechanism(scram.SHA256, s.Username, s.Password)
+	case KafkaSaslScramSha512:
+		return scram.Mechanism(scram.SHA512, s.Username, s.Password)
+	default:
+		return nil, fmt.Errorf("unsupported SASL mechanism %q", s.SaslMechanism)
+	}
+}
+
+func (k *KafkaEventEmitter) Name() string {
+	return "kafka"
+}
+
+func (k *KafkaEventEmitter) Emit(ctx context.Context, event *Event) error {
+	message, err := k.routing.message(event)
+	if err != nil {
+		return err
 	}
+	return k.writer.WriteMessages(ctx, message)
 }
 
-func (k *KafkaEventEmitter) Emit(event *Event) error {
+// EmitBatch writes the events in a single WriteMessages call, which kafka-go groups
+// into one produce request per partition.
+func (k *KafkaEventEmitter) EmitBatch(ctx context.Context, events []*Event) []error {
+	errs := make([]error, len(events))
+	messages := make([]kafka.Message, 0, len(events))
+	indexes := make([]int, 0, len(events))
+	for i, event := range events {
+		message, err := k.routing.message(event)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		messages = append(messages, message)
+		indexes = append(indexes, i)
+	}
+	if len(messages) == 0 {
+		return errs
+	}
+	err := k.writer.WriteMessages(ctx, messages...)
+	var writeErrors kafka.WriteErrors
+	for j, i := range indexes {
+		if errors.As(err, &writeErrors) {
+			errs[i] = writeErrors[j]
+		} else {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// message builds the message an event is written as, shared by the Kafka emitters.
+func (r KafkaRouting) message(event *Event) (kafka.Message, error) {
 	eventBytes, err := json.Marshal(event)
 	if err != nil {
 		slog.Error("Error on emit event", "event", event, "error", err)
-		return err
+		return kafka.Message{}, err
+	}
+	headers := []kafka.Header{
+		{Key: "event_name", Value: []byte(event.Name)},
+		{Key: "event_id", Value: []byte(event.ID)},
 	}
-	message := kafka.Message{
-		Value: eventBytes,
-		Topic: event.Name,
-		Key:   []byte(event.ID),
+	if !event.CreatedAt.IsZero() {
+		headers = append(headers, kafka.Header{Key: "created_at", Value: []byte(event.CreatedAt.Format(time.RFC3339Nano))})
 	}
-	return k.writer.WriteMessages(context.Background(), message)
+	// Metadata recorded by the producer, such as the W3C traceparent and tracestate.
+	for key, value := range event.Headers {
+		headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
+	}
+	return kafka.Message{
+		Topic:   r.topic(event),
+		Key:     []byte(r.key(event)),
+		Value:   eventBytes,
+		Headers: headers,
+	}, nil
+}
+
+func (r KafkaRouting) topic(event *Event) string {
+	topic, ok := r.Topics[event.Name]
+	if !ok {
+		topic = r.DefaultTopic
+	}
+	if topic == "" {
+		topic = event.Name
+	}
+	return r.TopicPrefix + topic
+}
+
+func (r KafkaRouting) key(event *Event) string {
+	if key := event.Payload[r.PartitionKey]; r.PartitionKey != "" && key != "" {
+		return key
+	}
+	return event.ID
+}
+
+func (k *KafkaEventEmitter) Close() error {
+	return k.writer.Close()
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// tracedOutbox is a record as the payment service saves it for a traced request.
+func tracedOutbox() *Outbox {
+	return &Outbox{
+		Id:        "1",
+		Name:      "PAYMENT_PROCESSED",
+		Payload:   `{"id":"1","name":"PAYMENT_PROCESSED","payload":{"purchaseId":"p-1"}}`,
+		Headers:   map[string]string{"traceparent": testTraceParent, "tracestate": "vendor=value"},
+		Status:    OutboxStatusPending,
+		CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestKafkaMessageCarriesTraceContext(t *testing.T) {
+	event, err := tracedOutbox().event()
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := KafkaRouting{PartitionKey: "purchaseId"}.message(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string]string{}
+	for _, header := range message.Headers {
+		headers[header.Key] = string(header.Value)
+	}
+	want := map[string]string{
+		"event_name":  "PAYMENT_PROCESSED",
+		"event_id":    "1",
+		"created_at":  "2024-05-01T12:00:00Z",
+		"traceparent": testTraceParent,
+		"tracestate":  "vendor=value",
+	}
+	for key, value := range want {
+		if headers[key] != value {
+			t.Errorf("header %s = %q, want %q", key, headers[key], value)
+		}
+	}
+	if string(message.Key) != "p-1" {
+		t.Errorf("key = %q, want p-1", message.Key)
+	}
+}
+
+func TestTransactionalKafkaRecordCarriesTraceContext(t *testing.T) {
+	event, err := tracedOutbox().event()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeTransactionalKafkaClient{}
+	emitter := &TransactionalKafkaEventEmitter{client: client}
+	if err := emitter.Emit(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.produced) != 1 {
+		t.Fatalf("produced %d records, want 1", len(client.produced))
+	}
+	for _, header := range client.produced[0].Headers {
+		if header.Key == "traceparent" {
+			if string(header.Value) != testTraceParent {
+				t.Errorf("traceparent = %q, want %q", header.Value, testTraceParent)
+			}
+			return
+		}
+	}
+	t.Error("record has no traceparent header")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+	"hash/fnv"
+	"sync"
+)
+
+// TransactionalKafkaEventEmitter writes every batch inside a Kafka transaction, so
+// consumers reading with read_committed see either all of its events or none. The
+// producer is idempotent, which keeps broker-side retries from duplicating messages,
+// and the outbox records are only updated once EmitBatch returned after the commit.
+// Messages are routed and keyed like KafkaEventEmitter's, and land on the same partitions.
+//
+// It is built on franz-go rather than kafka-go: kafka-go's Writer cannot produce
+// inside a transaction, as it never registers a transactional id nor sends a
+// producer id and epoch, and its Client only exposes the raw transaction requests.
+// Connections are secured from the same KafkaSecurity as KafkaEventEmitter's.
+type TransactionalKafkaEventEmitter struct {
+	client  transactionalKafkaClient
+	routing KafkaRouting
+	// A transactional producer runs one transaction at a time.
+	mutex sync.Mutex
+}
+
+// transactionalKafkaClient is the part of *kgo.Client the emitter runs its transactions with.
+type transactionalKafkaClient interface {
+	BeginTransaction() error
+	Produce(ctx context.Context, record *kgo.Record, promise func(*kgo.Record, error))
+	Flush(ctx context.Context) error
+	AbortBufferedRecords(ctx context.Context) error
+	EndTransaction(ctx context.Context, commit kgo.TransactionEndTry) error
+	Close()
+}
+
+func NewTransactionalKafkaEventEmitter(brokers []string, transactionalId string, routing KafkaRouting, security KafkaSecurity) (*TransactionalKafkaEventEmitter, error) {
+	securityOpts, err := security.kgoOpts()
+	if err != nil {
+		return nil, err
+	}
+	opts := append([]kgo.Opt{
+		kgo.SeedBrokers(brokers...),
+		kgo.TransactionalID(transactionalId),
+		kgo.RecordPartitioner(kgo.StickyKeyPartitioner(kgo.SaramaCompatHasher(fnv32a))),
+	}, securityOpts...)
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &TransactionalKafkaEventEmitter{client: client, routing: routing}, nil
+}
+
+// kgoOpts applies the TLS and SASL settings to a franz-go client, the way mechanism
+// and the Transport do for kafka-go.
+func (s KafkaSecurity) kgoOpts() ([]kgo.Opt, error) {
+	var opts []kgo.Opt
+	if s.TLS != nil {
+		opts = append(opts, kgo.DialTLSConfig(s.TLS))
+	}
+	switch s.SaslMechanism {
+	case "":
+	case KafkaSaslPlain:
+		opts = append(opts, kgo.SASL(plain.Auth{User: s.Username, Pass: s.Password}.AsMechanism()))
+	case KafkaSaslScramSha256:
+		opts = append(opts, kgo.SASL(scram.Auth{User: s.Username, Pass: s.Password}.AsSha256Mechanism()))
+	case KafkaSaslScramSha512:
+		opts = append(opts, kgo.SASL(scram.Auth{User: s.Username, Pass: s.Password}.AsSha512Mechanism()))
+	default:
+		return nil, fmt.Errorf("unsupported SASL mechanism %q", s.SaslMechanism)
+	}
+	return opts, nil
+}
+
+func (k *TransactionalKafkaEventEmitter) Name() string {
+	return "kafka"
+}
+
+func (k *TransactionalKafkaEventEmitter) Emit(ctx context.Context, event *Event) error {
+	return k.EmitBatch(ctx, []*Event{event})[0]
+}
+
+// EmitBatch produces the events in one transaction. Either the transaction commits
+// and every event is emitted, or it is aborted and every event reports the cause.
+func (k *TransactionalKafkaEventEmitter) EmitBatch(ctx context.Context, events []*Event) []error {
+	errs := make([]error, len(events))
+	records := make([]*kgo.Record, 0, len(events))
+	indexes := make([]int, 0, len(events))
+	for i, event := range events {
+		message, err := k.routing.message(event)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		record := &kgo.Record{Topic: message.Topic, Key: message.Key, Value: message.Value}
+		for _, header := range message.Headers {
+			record.Headers = append(record.Headers, kgo.RecordHeader{Key: header.Key, Value: header.Value})
+		}
+		records = append(records, record)
+		indexes = append(indexes, i)
+	}
+	if len(records) == 0 {
+		return errs
+	}
+	err := k.produce(ctx, records)
+	for _, i := range indexes {
+		errs[i] = err
+	}
+	return errs
+}
+
+func (k *TransactionalKafkaEventEmitter) produce(ctx context.Context, records []*kgo.Record) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if err := k.client.BeginTransaction(); err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	var produceMutex sync.Mutex
+	var produceErr error
+	for _, record := range records {
+		k.client.Produce(ctx, record, func(_ *kgo.Record, err error) {
+			if err != nil {
+				produceMutex.Lock()
+				produceErr = errors.Join(produceErr, err)
+				produceMutex.Unlock()
+			}
+		})
+	}
+	if err := k.client.Flush(ctx); err != nil {
+		produceErr = errors.Join(produceErr, err)
+	}
+	if produceErr != nil {
+		return k.abort(ctx, produceErr)
+	}
+	if err := k.client.EndTransaction(ctx, kgo.TryCommit); err != nil {
+		return k.abort(ctx, fmt.Errorf("committing transaction: %w", err))
+	}
+	return nil
+}
+
+// abort rolls the transaction back, keeping the error that caused it.
+func (k *TransactionalKafkaEventEmitter) abort(ctx context.Context, cause error) error {
+	// The abort has to go through even when ctx is what failed the transaction.
+	ctx = context.WithoutCancel(ctx)
+	if err := k.client.AbortBufferedRecords(ctx); err != nil {
+		return errors.Join(cause, fmt.Errorf("aborting buffered records: %w", err))
+	}
+	if err := k.client.EndTransaction(ctx, kgo.TryAbort); err != nil {
+		return errors.Join(cause, fmt.Errorf("aborting transaction: %w", err))
+	}
+	return cause
+}
+
+func (k *TransactionalKafkaEventEmitter) Close() error {
+	k.client.Close()
+	return nil
+}
+
+// fnv32a hashes keys like kafka-go's Hash balancer does.
+func fnv32a(key []byte) uint32 {
+	hash := fnv.New32a()
+	hash.Write(key)
+	return hash.Sum32()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"testing"
+)
+
+// fakeTransactionalKafkaClient records the transaction calls and fails the
+// produce of the records whose topic is in failTopics.
+type fakeTransactionalKafkaClient struct {
+	failTopics map[string]error
+	commitErr  error
+
+	calls    []string
+	produced []*kgo.Record
+}
+
+func (c *fakeTransactionalKafkaClient) BeginTransaction() error {
+	c.calls = append(c.calls, "begin")
+	return nil
+}
+
+func (c *fakeTransactionalKafkaClient) Produce(_ context.Context, record *kgo.Record, promise func(*kgo.Record, error)) {
+	c.produced = append(c.produced, record)
+	promise(record, c.failTopics[record.Topic])
+}
+
+func (c *fakeTransactionalKafkaClient) Flush(context.Context) error {
+	c.calls = append(c.calls, "flush")
+	return nil
+}
+
+func (c *fakeTransactionalKafkaClient) AbortBufferedRecords(context.Context) error {
+	c.calls = append(c.calls, "abort buffered")
+	return nil
+}
+
+func (c *fakeTransactionalKafkaClient) EndTransaction(_ context.Context, commit kgo.TransactionEndTry) error {
+	if commit == kgo.TryCommit {
+		c.calls = append(c.calls, "commit")
+		return c.commitErr
+	}
+	c.calls = append(c.calls, "abort")
+	return nil
+}
+
+func (c *fakeTransactionalKafkaClient) Close() {}
+
+func transactionalTestEvents() []*Event {
+	return []*Event{
+		{ID: "1", Name: "order_created", Payload: map[string]string{"order_id": "a"}},
+		{ID: "2", Name: "order_paid", Payload: map[string]string{"order_id": "a"}},
+		{ID: "3", Name: "order_created", Payload: map[string]string{"order_id": "b"}},
+	}
+}
+
+func assertCalls(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("calls = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("calls = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestTransactionalKafkaEmitBatchCommits(t *testing.T) {
+	client := &fakeTransactionalKafkaClient{}
+	emitter := &TransactionalKafkaEventEmitter{client: client, routing: KafkaRouting{TopicPrefix: "outbox.", PartitionKey: "order_id"}}
+
+	errs := emitter.EmitBatch(context.Background(), transactionalTestEvents())
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("event %d: unexpected error %v", i, err)
+		}
+	}
+	assertCalls(t, client.calls, "begin", "flush", "commit")
+	wantTopics := []string{"outbox.order_created", "outbox.order_paid", "outbox.order_created"}
+	wantKeys := []string{"a", "a", "b"}
+	if len(client.produced) != len(wantTopics) {
+		t.Fatalf("produced %d records, want %d", len(client.produced), len(wantTopics))
+	}
+	for i, record := range client.produced {
+		if record.Topic != wantTopics[i] || string(record.Key) != wantKeys[i] {
+			t.Errorf("record %d went to %s with key %s, want %s with key %s", i, record.Topic, record.Key, wantTopics[i], wantKeys[i])
+		}
+	}
+}
+
+func TestTransactionalKafkaEmitBatchAbortsOnProduceFailure(t *testing.T) {
+	produceErr := errors.New("not leader for partition")
+	client := &fakeTransactionalKafkaClient{failTopics: map[string]error{"order_paid": produceErr}}
+	emitter := &TransactionalKafkaEventEmitter{client: client}
+
+	errs := emitter.EmitBatch(context.Background(), transactionalTestEvents())
+
+	assertCalls(t, client.calls, "begin", "flush", "abort buffered", "abort")
+	// The whole transaction is rolled back, so every outbox record of the batch
+	// reports the failure, not only the one whose produce failed.
+	for i, err := range errs {
+		if !errors.Is(err, produceErr) {
+			t.Errorf("event %d: error = %v, want %v", i, err, produceErr)
+		}
+	}
+}
+
+func TestTransactionalKafkaEmitBatchAbortsOnCommitFailure(t *testing.T) {
+	commitErr := errors.New("producer fenced")
+	client := &fakeTransactionalKafkaClient{commitErr: commitErr}
+	emitter := &TransactionalKafkaEventEmitter{client: client}
+
+	errs := emitter.EmitBatch(context.Background(), transactionalTestEvents())
+
+	assertCalls(t, client.calls, "begin", "flush", "commit", "abort buffered", "abort")
+	for i, err := range errs {
+		if !errors.Is(err, commitErr) {
+			t.Errorf("event %d: error = %v, want %v", i, err, commitErr)
+		}
+	}
+}
+
+func TestTransactionalKafkaEmitReportsItsOwnError(t *testing.T) {
+	produceErr := errors.New("message too large")
+	client := &fakeTransactionalKafkaClient{failTopics: map[string]error{"order_created": produceErr}}
+	emitter := &TransactionalKafkaEventEmitter{client: client}
+
+	if err := emitter.Emit(context.Background(), transactionalTestEvents()[0]); !errors.Is(err, produceErr) {
+		t.Errorf("error = %v, want %v", err, produceErr)
+	}
+	assertCalls(t, client.calls, "begin", "flush", "abort buffered", "abort")
+}
+
+func TestTransactionalKafkaEmitBatchWithoutEvents(t *testing.T) {
+	client := &fakeTransactionalKafkaClient{}
+	emitter := &TransactionalKafkaEventEmitter{client: client}
+
+	if errs := emitter.EmitBatch(context.Background(), nil); len(errs) != 0 {
+		t.Errorf("errs = %v, want none", errs)
+	}
+	assertCalls(t, client.calls)
+}
+
+func TestTransactionalKafkaAppliesSecurityLikeKafkaGo(t *testing.T) {
+	tlsConfig := &tls.Config{ServerName: "kafka.internal"}
+	for _, mechanism := range []string{"", KafkaSaslPlain, KafkaSaslScramSha256, KafkaSaslScramSha512} {
+		t.Run("sasl "+mechanism, func(t *testing.T) {
+			security := KafkaSecurity{TLS: tlsConfig, SaslMechanism: mechanism, Username: "user", Password: "secret"}
+			emitter, err := NewTransactionalKafkaEventEmitter([]string{"localhost:9092"}, "outbox", KafkaRouting{}, security)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer emitter.Close()
+			client := emitter.client.(*kgo.Client)
+
+			if got, _ := client.OptValue(kgo.DialTLSConfig).(*tls.Config); got != tlsConfig {
+				t.Errorf("TLS config = %v, want the configured one", got)
+			}
+			kafkaGoMechanism, err := security.mechanism()
+			if err != nil {
+				t.Fatal(err)
+			}
+			mechanisms, _ := client.OptValue(kgo.SASL).([]sasl.Mechanism)
+			switch {
+			case kafkaGoMechanism == nil && len(mechanisms) != 0:
+				t.Errorf("SASL mechanisms = %v, want none", mechanisms)
+			case kafkaGoMechanism != nil && (len(mechanisms) != 1 || mechanisms[0].Name() != kafkaGoMechanism.Name()):
+				t.Errorf("SASL mechanisms = %v, want %s", mechanisms, kafkaGoMechanism.Name())
+			}
+		})
+	}
+}
+
+func TestTransactionalKafkaRejectsUnsupportedSasl(t *testing.T) {
+	_, err := NewTransactionalKafkaEventEmitter([]string{"localhost:9092"}, "outbox", KafkaRouting{}, KafkaSecurity{SaslMechanism: "GSSAPI"})
+	if err == nil {
+		t.Error("expected an error for an unsupported SASL mechanism")
+	}
+}
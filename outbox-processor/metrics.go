@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log/slog"
+	"net/http"
+)
+
+// Metrics are published with expvar and served as JSON on /debug/vars.
+var (
+	sweeperRuns    = expvar.NewInt("outbox_sweeper_runs")
+	sweeperErrors  = expvar.NewInt("outbox_sweeper_errors")
+	sweeperRescued = expvar.NewMap("outbox_sweeper_rescued")
+	queueDepth     = expvar.NewInt("outbox_queue_depth")
+	delayedDepth   = expvar.NewInt("outbox_delayed_depth")
+	delayedDropped = expvar.NewInt("outbox_delayed_dropped")
+	busyWorkers    = expvar.NewInt("outbox_busy_workers")
+)
+
+// HealthChecker is implemented by components that can tell whether they are able to do their work.
+type HealthChecker interface {
+	Healthy() error
+}
+
+// serveMetrics serves the metrics along with /healthz, which reports 503 while any
+// of the given components is unhealthy.
+func serveMetrics(addr string, components map[string]HealthChecker) {
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		report := make(map[string]string, len(components))
+		for name, component := range components {
+			report[name] = "ok"
+			if err := component.Healthy(); err != nil {
+				status = http.StatusServiceUnavailable
+				report[name] = err.Error()
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+	})
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		slog.Error("Metrics server stopped", "addr", addr, "error", err)
+	}
+}
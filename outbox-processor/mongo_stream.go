@@ -2,109 +2,222 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
+	"log/slog"
 	"time"
 )
 
+// MongoResumePolicy decides what to do when the persisted resume token has fallen
+// off the oplog, meaning changes happened that the change stream can no longer replay.
+type MongoResumePolicy string
+
+const (
+	// MongoResumeRescan watches from now on and scans the collection for every
+	// record still waiting to be processed, so nothing in the gap is lost.
+	MongoResumeRescan MongoResumePolicy = "rescan"
+	// MongoResumeFail reports the gap as a stream error and stops.
+	MongoResumeFail MongoResumePolicy = "fail"
+
+	DefaultResumeTokenInterval = 5 * time.Second
+
+	// changeStreamHistoryLost is the server error returned when resuming from a token no longer in the oplog.
+	changeStreamHistoryLost = 286
+)
+
 type MongoStream struct {
-	collection *mongo.Collection
+	collection          *mongo.Collection
+	checkpoints         CheckpointStore
+	outboxRepository    OutboxRepository
+	resumePolicy        MongoResumePolicy
+	resumeTokenInterval time.Duration
+	errors              chan error
+}
+
+func NewMongoStream(collection *mongo.Collection, checkpoints CheckpointStore, resumePolicy MongoResumePolicy) *MongoStream {
+	return &MongoStream{
+		collection:          collection,
+		checkpoints:         checkpoints,
+		outboxRepository:    NewMongoOutboxRepository(collection),
+		resumePolicy:        resumePolicy,
+		resumeTokenInterval: DefaultResumeTokenInterval,
+		errors:              make(chan error, 1),
+	}
 }
 
-func NewMongoStream(collection *mongo.Collection) *MongoStream {
-	return &MongoStream{collection: collection}
+func (stream *MongoStream) FetchEvents(ctx context.Context) (chan *Outbox, error) {
+	changeStream, rescan, err := stream.watch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ch := newEventChannel(ctx)
+	if rescan {
+		ch.goTracked(func() { stream.consumeExistingEvents(ctx, ch) })
+	}
+	ch.goTracked(func() { stream.consumeChanges(ctx, changeStream, ch) })
+	ch.closeWhenDone()
+	return ch.events, nil
+}
+
+func (stream *MongoStream) Errors() <-chan error {
+	return stream.errors
+}
+
+func (stream *MongoStream) fail(err error) {
+	select {
+	case stream.errors <- err:
+	default:
+	}
+}
+
+func (stream *MongoStream) resumeTokenKey() string {
+	return "change_stream:" + stream.collection.Name()
+}
+
+// watch opens the change stream after the persisted resume token. It also reports
+// whether the collection must be scanned for existing records, which is the case
+// when there is no token to resume from or the token was lost and the policy allows it.
+func (stream *MongoStream) watch(ctx context.Context) (*mongo.ChangeStream, bool, error) {
+	savedToken, err := stream.checkpoints.Get(ctx, stream.resumeTokenKey())
+	if err != nil {
+		return nil, false, err
+	}
+	if savedToken == "" {
+		changeStream, err := stream.openChangeStream(ctx, nil)
+		return changeStream, true, err
+	}
+	var resumeToken bson.Raw
+	if err := bson.UnmarshalExtJSON([]byte(savedToken), false, &resumeToken); err != nil {
+		return nil, false, fmt.Errorf("invalid resume token: %w", err)
+	}
+	changeStream, err := stream.openChangeStream(ctx, resumeToken)
+	if err == nil {
+		return changeStream, false, nil
+	}
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) || !serverErr.HasErrorCode(changeStreamHistoryLost) {
+		return nil, false, err
+	}
+	if stream.resumePolicy == MongoResumeFail {
+		return nil, false, fmt.Errorf("resume token fell off the oplog: %w", err)
+	}
+	slog.Warn("Resume token fell off the oplog, rescanning pending records", "collection", stream.collection.Name())
+	changeStream, err = stream.openChangeStream(ctx, nil)
+	return changeStream, true, err
 }
 
-func (stream *MongoStream) FetchEvents() (chan string, error) {
-	ch := make(chan string)
-	go stream.consumeExistingEvents(ch)
-	go stream.consumeErrorEvents(ch)
-	go stream.consumeNewEvents(ch)
-	return ch, nil
+func (stream *MongoStream) openChangeStream(ctx context.Context, resumeToken bson.Raw) (*mongo.ChangeStream, error) {
+	// Inserts are new records, updates back to PENDING come from records redriven out of
+	// the dead letters or postponed, and ERROR updates are handed back once their next
+	// attempt is due. IN_PROGRESS updates are mostly this processor's own claims; the
+	// records whose lease expires are found by the initial scan and the sweeper.
+	pipeline := mongo.Pipeline{bson.D{{Key: "$match", Value: bson.M{"$or": bson.A{
+		bson.M{"operationType": "insert"},
+		bson.M{
+			"operationType":       "update",
+			"fullDocument.status": bson.M{"$in": bson.A{OutboxStatusPending, OutboxStatusError}},
+		},
+	}}}}}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if resumeToken != nil {
+		opts.SetStartAfter(resumeToken)
+	}
+	return stream.collection.Watch(ctx, pipeline, opts)
 }
 
-func (stream *MongoStream) consumeExistingEvents(ch chan string) {
-	cursor, err := stream.collection.Find(context.TODO(), bson.M{"status": bson.M{"$ne": "PROCESSED"}})
+func (stream *MongoStream) consumeExistingEvents(ctx context.Context, ch *eventChannel) {
+	// Records whose claim expired, e.g. when a replica crashed, are reclaimed too.
+	filter := bson.M{"$or": bson.A{
+		bson.M{"status": bson.M{"$in": bson.A{OutboxStatusPending, OutboxStatusError}}},
+		bson.M{"status": OutboxStatusInProgress, "lease_expires_at": bson.M{"$not": bson.M{"$gte": time.Now()}}},
+	}}
+	cursor, err := stream.collection.Find(ctx, filter)
 	if err != nil {
-		log.Fatalf("Failed to find existing events: %v", err)
+		if ctx.Err() == nil {
+			stream.fail(fmt.Errorf("failed to find existing events: %w", err))
+		}
+		return
 	}
-	defer cursor.Close(context.TODO())
+	defer cursor.Close(context.WithoutCancel(ctx))
 
-	for cursor.Next(context.TODO()) {
+	for cursor.Next(ctx) {
 		var outbox Outbox
 		if err := cursor.Decode(&outbox); err != nil {
 			log.Printf("Failed to decode existing outbox: %v", err)
 			continue
 		}
-		ch <- outbox.Id
+		if !ch.dispatch(&outbox) {
+			return
+		}
 	}
 
-	if err := cursor.Err(); err != nil {
+	if err := cursor.Err(); err != nil && ctx.Err() == nil {
 		log.Printf("Cursor error: %v", err)
 	}
 }
 
-func (stream *MongoStream) consumeNewEvents(ch chan string) {
-	pipeline := mongo.Pipeline{bson.D{{"$match", bson.D{{"operationType", "insert"}}}}}
-	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
-	changeStream, err := stream.collection.Watch(context.TODO(), pipeline, opts)
-	if err != nil {
-		log.Fatalf("Failed to start change stream: %v", err)
-	}
-
-	defer changeStream.Close(context.TODO())
-	defer close(ch)
+// consumeChanges delivers the change stream until ctx is done. The resume token
+// is only advanced past events that were handed over, and saved one last time
+// on the way out.
+func (stream *MongoStream) consumeChanges(ctx context.Context, changeStream *mongo.ChangeStream, ch *eventChannel) {
+	flushCtx := context.WithoutCancel(ctx)
+	defer changeStream.Close(flushCtx)
+	var resumeToken bson.Raw
+	defer func() { stream.saveResumeToken(flushCtx, resumeToken) }()
+	lastSaved := time.Now()
 
-	for changeStream.Next(context.TODO()) {
-		var changeEvent struct {
-			DocumentKey primitive.M `bson:"documentKey,omitempty"`
-		}
-		if err := changeStream.Decode(&changeEvent); err != nil {
+	for changeStream.Next(ctx) {
+		outbox, err := stream.decodeChange(ctx, changeStream)
+		if err != nil {
 			log.Printf("Failed to decode change stream document: %v", err)
-			continue
+		} else if outbox != nil && !ch.dispatch(outbox) {
+			return
+		}
+		resumeToken = changeStream.ResumeToken()
+
+		if time.Since(lastSaved) >= stream.resumeTokenInterval {
+			stream.saveResumeToken(ctx, resumeToken)
+			lastSaved = time.Now()
 		}
-		ch <- changeEvent.DocumentKey["_id"].(string)
 	}
 
-	if err := changeStream.Err(); err != nil {
-		log.Printf("Change stream error: %v", err)
+	if err := changeStream.Err(); err != nil && ctx.Err() == nil {
+		stream.fail(fmt.Errorf("change stream error: %w", err))
 	}
 }
 
-func (stream *MongoStream) consumeErrorEvents(ch chan string) {
-	pipeline := mongo.Pipeline{bson.D{
-		{"$match", bson.D{
-			{"operationType", "update"},
-			{"fullDocument.status", "ERROR"},
-		}},
-	}}
-	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
-	changeStream, err := stream.collection.Watch(context.TODO(), pipeline, opts)
-	if err != nil {
-		log.Fatalf("Failed to start change stream: %v", err)
+// decodeChange returns the record looked up by the change stream, falling back to
+// reading it when the event carries no document. It is nil when the record is gone.
+func (stream *MongoStream) decodeChange(ctx context.Context, changeStream *mongo.ChangeStream) (*Outbox, error) {
+	var changeEvent struct {
+		DocumentKey struct {
+			Id string `bson:"_id"`
+		} `bson:"documentKey"`
+		FullDocument *Outbox `bson:"fullDocument,omitempty"`
 	}
-
-	defer changeStream.Close(context.TODO())
-	defer close(ch)
-
-	for changeStream.Next(context.TODO()) {
-		var changeEvent struct {
-			DocumentKey primitive.M `bson:"documentKey,omitempty"`
-		}
-		if err := changeStream.Decode(&changeEvent); err != nil {
-			log.Printf("Failed to decode change stream document: %v", err)
-			continue
-		}
-		go func() {
-			time.Sleep(time.Second * 5)
-			ch <- changeEvent.DocumentKey["_id"].(string)
-		}()
+	if err := changeStream.Decode(&changeEvent); err != nil {
+		return nil, err
+	}
+	if changeEvent.FullDocument != nil {
+		return changeEvent.FullDocument, nil
 	}
+	return stream.outboxRepository.Get(ctx, changeEvent.DocumentKey.Id)
+}
 
-	if err := changeStream.Err(); err != nil {
-		log.Printf("Change stream error: %v", err)
+func (stream *MongoStream) saveResumeToken(ctx context.Context, resumeToken bson.Raw) {
+	if resumeToken == nil {
+		return
+	}
+	token, err := bson.MarshalExtJSON(resumeToken, false, false)
+	if err != nil {
+		slog.Error("Error encoding resume token", "error", err)
+		return
+	}
+	if err := stream.checkpoints.Save(ctx, stream.resumeTokenKey(), string(token)); err != nil {
+		slog.Error("Error saving resume token", "collection", stream.collection.Name(), "error", err)
 	}
 }
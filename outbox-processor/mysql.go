@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type (
+	// MySqlOutboxRepository stores records in the table created by migrations/mysql.
+	// The connection must parse times in UTC and report found rather than changed
+	// rows, see mySqlConfigFromEnv.
+	MySqlOutboxRepository struct {
+		db        *sql.DB
+		tableName string
+	}
+
+	MySqlDeadLetterRepository struct {
+		db        *sql.DB
+		tableName string
+	}
+
+	MySqlCheckpointStore struct {
+		db        *sql.DB
+		tableName string
+	}
+)
+
+func NewMySqlOutboxRepository(db *sql.DB, tableName string) *MySqlOutboxRepository {
+	return &MySqlOutboxRepository{db: db, tableName: mySqlIdentifier(tableName)}
+}
+
+func NewMySqlDeadLetterRepository(db *sql.DB, tableName string) DeadLetterRepository {
+	return &MySqlDeadLetterRepository{db: db, tableName: mySqlIdentifier(tableName)}
+}
+
+func NewMySqlCheckpointStore(db *sql.DB, tableName string) CheckpointStore {
+	return &MySqlCheckpointStore{db: db, tableName: mySqlIdentifier(tableName)}
+}
+
+func (r *MySqlOutboxRepository) Update(ctx context.Context, outbox *Outbox) error {
+	if err := r.update(ctx, r.db, outbox); err != nil {
+		return err
+	}
+	outbox.Version++
+	return nil
+}
+
+// UpdateBatch runs the updates in one transaction, like the Postgres repository.
+func (r *MySqlOutboxRepository) UpdateBatch(ctx context.Context, outboxes []*Outbox) []error {
+	errs := make([]error, len(outboxes))
+	if len(outboxes) == 0 {
+		return errs
+	}
+	failAll := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return failAll(err)
+	}
+	defer tx.Rollback()
+	for i, outbox := range outboxes {
+		err := r.update(ctx, tx, outbox)
+		if err != nil && !errors.Is(err, ErrConcurrentModification) {
+			return failAll(err)
+		}
+		errs[i] = err
+	}
+	if err := tx.Commit(); err != nil {
+		return failAll(err)
+	}
+	for i, outbox := range outboxes {
+		if errs[i] == nil {
+			outbox.Version++
+		}
+	}
+	return errs
+}
+
+func (r *MySqlOutboxRepository) update(ctx context.Context, db sqlExecutor, outbox *Outbox) error {
+	history, err := historyColumn(outbox.History)
+	if err != nil {
+		return err
+	}
+	result, err := db.ExecContext(ctx, `UPDATE `+r.tableName+` SET
+		status = ?, processed_at = ?, last_attempt_time = ?, attempts = ?, next_attempt_at = ?,
+		last_error = NULLIF(?, ''), history = ?, owner = NULLIF(?, ''), lease_expires_at = ?,
+		version = version + 1
+		WHERE id = ? AND version = ?`,
+		outbox.Status, outbox.ProcessedAt, outbox.LastAttemptTime, outbox.Attempts, outbox.NextAttemptAt,
+		outbox.LastError, history, outbox.Owner, outbox.LeaseExpiresAt, outbox.Id, outbox.Version,
+	)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return ErrConcurrentModification
+	}
+	return nil
+}
+
+func (r *MySqlOutboxRepository) Get(ctx context.Context, id string) (*Outbox, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+sqlOutboxColumns+` FROM `+r.tableName+` WHERE id = ?`, id)
+	outbox, err := scanOutbox(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return outbox, err
+}
+
+// Claim also succeeds on a record owner already holds, at the same version, since
+// PollingStream claims the records before delivering them; the lease is renewed.
+func (r *MySqlOutboxRepository) Claim(ctx context.Context, outbox *Outbox, owner string, lease time.Duration) (*Outbox, error) {
+	now := time.Now()
+	claimed := outbox.claimedBy(owner, now.Add(lease))
+	result, err := r.db.ExecContext(ctx, `UPDATE `+r.tableName+` SET
+		status = ?, owner = ?, lease_expires_at = ?, version = version + 1
+		WHERE id = ? AND version = ? AND (
+			status IN ('`+OutboxStatusPending+`', '`+OutboxStatusError+`')
+			OR (status = '`+OutboxStatusInProgress+`' AND (lease_expires_at IS NULL OR lease_expires_at < ? OR owner = ?))
+		)`,
+		claimed.Status, claimed.Owner, claimed.LeaseExpiresAt, outbox.Id, outbox.Version, now, owner,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claimedRows, err := result.RowsAffected(); err != nil || claimedRows == 0 {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// ClaimDue locks the due records with FOR UPDATE SKIP LOCKED and claims them in
+// the same transaction, since MySQL cannot return the rows an UPDATE changed.
+func (r *MySqlOutboxRepository) ClaimDue(ctx context.Context, owner string, lease time.Duration, limit int) ([]*Outbox, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	rows, err := tx.QueryContext(ctx, `SELECT `+sqlOutboxColumns+` FROM `+r.tableName+`
+		WHERE (status IN ('`+OutboxStatusPending+`', '`+OutboxStatusError+`') AND (next_attempt_at IS NULL OR next_attempt_at <= ?))
+			OR (status = '`+OutboxStatusInProgress+`' AND (lease_expires_at IS NULL OR lease_expires_at < ?))
+		ORDER BY created_at
+		LIMIT ?
+		FOR UPDATE SKIP LOCKED`,
+		now, now, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	due, err := scanOutboxes(rows)
+	if err != nil || len(due) == 0 {
+		return nil, err
+	}
+	until := now.Add(lease)
+	args := []any{OutboxStatusInProgress, owner, until}
+	for _, outbox := range due {
+		args = append(args, outbox.Id)
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE `+r.tableName+` SET
+		status = ?, owner = ?, lease_expires_at = ?, version = version + 1
+		WHERE id IN (`+sqlPlaceholders(len(due))+`)`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	claimed := make([]*Outbox, len(due))
+	for i, outbox := range due {
+		claimed[i] = outbox.claimedBy(owner, until)
+	}
+	return claimed, nil
+}
+
+func (r *MySqlOutboxRepository) NextDueAt(ctx context.Context) (*time.Time, error) {
+	var dueAt *time.Time
+	err := r.db.QueryRowContext(ctx, `SELECT MIN(CASE
+			WHEN status = '`+OutboxStatusInProgress+`' THEN lease_expires_at
+			ELSE COALESCE(next_attempt_at, created_at)
+		END) FROM `+r.tableName+`
+		WHERE status IN ('`+OutboxStatusPending+`', '`+OutboxStatusError+`', '`+OutboxStatusInProgress+`')`,
+	).Scan(&dueAt)
+	return dueAt, err
+}
+
+func (r *MySqlOutboxRepository) FindStuck(ctx context.Context, before time.Time, limit int) ([]*Outbox, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+sqlOutboxColumns+` FROM `+r.tableName+`
+		WHERE (status = '`+OutboxStatusPending+`' AND created_at < ? AND (next_attempt_at IS NULL OR next_attempt_at < ?))
+			OR (status = '`+OutboxStatusError+`' AND (next_attempt_at IS NULL OR next_attempt_at < ?))
+			OR (status = '`+OutboxStatusInProgress+`' AND (lease_expires_at IS NULL OR lease_expires_at < ?))
+		ORDER BY created_at
+		LIMIT ?`,
+		before, before, before, time.Now(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanOutboxes(rows)
+}
+
+func (r *MySqlOutboxRepository) FindUnfinishedBefore(ctx context.Context, outbox *Outbox) (*Outbox, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+sqlOutboxColumns+` FROM `+r.tableName+`
+		WHERE ordering_key = ? AND created_at < ?
+			AND status NOT IN ('`+OutboxStatusProcessed+`', '`+OutboxStatusDead+`')
+		ORDER BY created_at
+		LIMIT 1`,
+		outbox.OrderingKey, outbox.CreatedAt,
+	)
+	earliest, err := scanOutbox(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return earliest, err
+}
+
+func (r *MySqlDeadLetterRepository) Send(ctx context.Context, deadLetter *DeadLetter) error {
+	history, err := historyColumn(deadLetter.History)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, `INSERT INTO `+r.tableName+`
+		(id, name, payload, created_at, dead_at, attempts, last_error, history, emitter)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			name = VALUES(name), payload = VALUES(payload), created_at = VALUES(created_at),
+			dead_at = VALUES(dead_at), attempts = VALUES(attempts), last_error = VALUES(last_error),
+			history = VALUES(history), emitter = VALUES(emitter)`,
+		deadLetter.Id, deadLetter.Name, deadLetter.Payload, deadLetter.CreatedAt, deadLetter.DeadAt,
+		deadLetter.Attempts, deadLetter.LastError, history, deadLetter.Emitter,
+	)
+	return err
+}
+
+func (r *MySqlDeadLetterRepository) Find(ctx context.Context, filter DeadLetterFilter) ([]*DeadLetter, error) {
+	var conditions []string
+	var args []any
+	if len(filter.Ids) > 0 {
+		conditions = append(conditions, "id IN ("+sqlPlaceholders(len(filter.Ids))+")")
+		for _, id := range filter.Ids {
+			args = append(args, id)
+		}
+	}
+	if filter.Name != "" {
+		conditions = append(conditions, "name = ?")
+		args = append(args, filter.Name)
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "dead_at >= ?")
+		args = append(args, filter.From)
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "dead_at <= ?")
+		args = append(args, filter.To)
+	}
+	query := `SELECT id, name, payload, created_at, dead_at, attempts, last_error, history, emitter FROM ` + r.tableName
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var deadLetters []*DeadLetter
+	for rows.Next() {
+		var deadLetter DeadLetter
+		var history []byte
+		err := rows.Scan(
+			&deadLetter.Id, &deadLetter.Name, &deadLetter.Payload, &deadLetter.CreatedAt, &deadLetter.DeadAt,
+			&deadLetter.Attempts, &deadLetter.LastError, &history, &deadLetter.Emitter,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if len(history) > 0 {
+			if err := json.Unmarshal(history, &deadLetter.History); err != nil {
+				return nil, fmt.Errorf("invalid history of dead letter %s: %w", deadLetter.Id, err)
+			}
+		}
+		deadLetters = append(deadLetters, &deadLetter)
+	}
+	return deadLetters, rows.Err()
+}
+
+func (r *MySqlDeadLetterRepository) Delete(ctx context.Context, id string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM `+r.tableName+` WHERE id = ?`, id)
+	return err
+}
+
+func (s *MySqlCheckpointStore) Get(ctx context.Context, key string) (string, error) {
+	var position string
+	err := s.db.QueryRowContext(ctx, `SELECT position FROM `+s.tableName+` WHERE id = ?`, key).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return position, err
+}
+
+func (s *MySqlCheckpointStore) Save(ctx context.Context, key, position string) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO `+s.tableName+` (id, position, updated_at) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE position = VALUES(position), updated_at = VALUES(updated_at)`,
+		key, position, time.Now(),
+	)
+	return err
+}
+
+func mySqlIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// sqlPlaceholders returns count comma-separated ? placeholders.
+func sqlPlaceholders(count int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", count), ", ")
+}
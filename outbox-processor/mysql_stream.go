@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/siddontang/go-log/log"
+	"hash/fnv"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultMySqlCheckpointInterval = 5 * time.Second
+
+	mySqlMinReconnectBackoff = time.Second
+	mySqlMaxReconnectBackoff = 30 * time.Second
+	mySqlHeartbeatPeriod     = 10 * time.Second
+)
+
+// MySqlBinlogStream tails the row-based binlog of the outbox table, as a replica
+// with its own server id would. Records are delivered once their transaction
+// commits, and the GTID set executed so far is checkpointed under the table name,
+// so the stream resumes after the last transaction it handed over. Without a
+// checkpoint it starts from the server's current position; older records are left
+// to the sweeper. The checkpoint does not wait for records to be handled, so one
+// handed over but lost with a crash stays PENDING or ERROR in the table until the
+// sweeper finds it, rather than being replayed from the binlog.
+//
+// The server needs binlog_format=ROW, binlog_row_image=FULL and gtid_mode=ON, and
+// the user REPLICATION SLAVE and REPLICATION CLIENT. Column names are read from the
+// binlog with binlog_row_metadata=FULL, and from information_schema otherwise.
+type MySqlBinlogStream struct {
+	outboxRepository   *MySqlOutboxRepository
+	db                 *sql.DB
+	config             *mysqldriver.Config
+	tableName          string
+	serverId           uint32
+	checkpoints        CheckpointStore
+	checkpointInterval time.Duration
+	columns            []string
+	errors             chan error
+}
+
+func NewMySqlBinlogStream(outboxRepository *MySqlOutboxRepository, db *sql.DB, config *mysqldriver.Config, tableName string, serverId uint32, checkpoints CheckpointStore, checkpointInterval time.Duration) *MySqlBinlogStream {
+	return &MySqlBinlogStream{
+		outboxRepository:   outboxRepository,
+		db:                 db,
+		config:             config,
+		tableName:          tableName,
+		serverId:           serverId,
+		checkpoints:        checkpoints,
+		checkpointInterval: checkpointInterval,
+		errors:             make(chan error, 1),
+	}
+}
+
+// mySqlServerId derives the server id the stream registers with from owner, so
+// replicas get distinct ids without configuration. Zero is not a valid id.
+func mySqlServerId(owner string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(owner))
+	return max(hash.Sum32(), 1)
+}
+
+func (stream *MySqlBinlogStream) FetchEvents(ctx context.Context) (chan *Outbox, error) {
+	position, err := stream.startPosition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	events := newEventChannel(ctx)
+	events.goTracked(func() { stream.replicate(ctx, position, events) })
+	events.closeWhenDone()
+	return events.events, nil
+}
+
+func (stream *MySqlBinlogStream) Errors() <-chan error {
+	return stream.errors
+}
+
+func (stream *MySqlBinlogStream) fail(err error) {
+	select {
+	case stream.errors <- err:
+	default:
+	}
+}
+
+func (stream *MySqlBinlogStream) checkpointKey() string {
+	return "binlog:" + stream.config.DBName + "." + stream.tableName
+}
+
+// startPosition reads the checkpointed GTID set, or the one the server has
+// executed so far when there is no checkpoint yet.
+func (stream *MySqlBinlogStream) startPosition(ctx context.Context) (mysql.GTIDSet, error) {
+	saved, err := stream.checkpoints.Get(ctx, stream.checkpointKey())
+	if err != nil {
+		return nil, fmt.Errorf("reading binlog checkpoint: %w", err)
+	}
+	if saved == "" {
+		if err := stream.db.QueryRowContext(ctx, "SELECT @@GLOBAL.gtid_executed").Scan(&saved); err != nil {
+			return nil, fmt.Errorf("reading executed GTID set: %w", err)
+		}
+		slog.Info("No binlog checkpoint, starting from the current position", "gtid", saved)
+	}
+	return mysql.ParseGTIDSet(mysql.MySQLFlavor, saved)
+}
+
+// replicate streams the binlog until ctx is done, reconnecting with backoff when
+// the connection fails, or reporting the failure when retrying cannot help. The
+// position is saved on the way out, so the checkpoint covers every record handed over.
+func (stream *MySqlBinlogStream) replicate(ctx context.Context, position mysql.GTIDSet, events *eventChannel) {
+	saved := position.String()
+	save := func(ctx context.Context) {
+		if current := position.String(); current != saved {
+			if err := stream.checkpoints.Save(ctx, stream.checkpointKey(), current); err != nil {
+				slog.Error("Error saving binlog checkpoint", "gtid", current, "error", err)
+				return
+			}
+			saved = current
+		}
+	}
+	defer func() { save(context.WithoutCancel(ctx)) }()
+
+	backoff := mySqlMinReconnectBackoff
+	for {
+		started, err := stream.stream(ctx, &position, save, events)
+		if ctx.Err() != nil {
+			return
+		}
+		if isMySqlFatal(err) {
+			slog.Error("Error streaming the binlog", "error", err)
+			stream.fail(err)
+			return
+		}
+		if started {
+			backoff = mySqlMinReconnectBackoff
+		}
+		slog.Error("Error streaming the binlog, retrying", "backoff", backoff, "error", err)
+		if !sleep(ctx, backoff) {
+			return
+		}
+		backoff = min(backoff*2, mySqlMaxReconnectBackoff)
+	}
+}
+
+// stream reads the binlog on a new connection from position until it fails,
+// reporting whether it received anything. Rows of the outbox table are collected
+// until their transaction commits, then dispatched and position moves past them.
+func (stream *MySqlBinlogStream) stream(ctx context.Context, position *mysql.GTIDSet, save func(context.Context), events *eventChannel) (bool, error) {
+	syncerConfig, err := stream.syncerConfig()
+	if err != nil {
+		return false, err
+	}
+	syncer := replication.NewBinlogSyncer(syncerConfig)
+	defer syncer.Close()
+	streamer, err := syncer.StartSyncGTID((*position).Clone())
+	if err != nil {
+		return false, err
+	}
+	slog.Info("Streaming the binlog", "server_id", stream.serverId, "gtid", (*position).String())
+
+	started := false
+	nextCheckpoint := time.Now().Add(stream.checkpointInterval)
+	var transaction []*Outbox
+	for {
+		event, err := streamer.GetEvent(ctx)
+		if err != nil {
+			return started, err
+		}
+		started = true
+		switch data := event.Event.(type) {
+		case *replication.RowsEvent:
+			if !stream.isOutboxTable(data.Table) {
+				continue
+			}
+			switch event.Header.EventType {
+			case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+				for i := range data.Rows {
+					transaction = stream.appendRow(ctx, transaction, data, i)
+				}
+			case replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+				// Update events alternate the row images before and after the update.
+				for i := 1; i < len(data.Rows); i += 2 {
+					transaction = stream.appendRow(ctx, transaction, data, i)
+				}
+			}
+		case *replication.XIDEvent:
+			for _, outbox := range transaction {
+				if !events.dispatch(outbox) {
+					return started, ctx.Err()
+				}
+			}
+			transaction = nil
+			if data.GSet != nil {
+				*position = data.GSet
+			}
+			if !time.Now().Before(nextCheckpoint) {
+				save(ctx)
+				nextCheckpoint = time.Now().Add(stream.checkpointInterval)
+			}
+		}
+	}
+}
+
+func (stream *MySqlBinlogStream) syncerConfig() (replication.BinlogSyncerConfig, error) {
+	host, port, err := net.SplitHostPort(stream.config.Addr)
+	if err != nil {
+		return replication.BinlogSyncerConfig{}, fmt.Errorf("invalid MySQL address %s: %w", stream.config.Addr, err)
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return replication.BinlogSyncerConfig{}, fmt.Errorf("invalid MySQL port %s: %w", port, err)
+	}
+	return replication.BinlogSyncerConfig{
+		ServerID:        stream.serverId,
+		Flavor:          mysql.MySQLFlavor,
+		Host:            host,
+		Port:            uint16(portNumber),
+		User:            stream.config.User,
+		Password:        stream.config.Passwd,
+		TLSConfig:       stream.config.TLS,
+		ParseTime:       true,
+		HeartbeatPeriod: mySqlHeartbeatPeriod,
+		ReadTimeout:     3 * mySqlHeartbeatPeriod,
+		// Errors are logged by the stream itself.
+		Logger: log.NewDefault(&log.NullHandler{}),
+	}, nil
+}
+
+func (stream *MySqlBinlogStream) isOutboxTable(table *replication.TableMapEvent) bool {
+	return table != nil && string(table.Schema) == stream.config.DBName && string(table.Table) == stream.tableName
+}
+
+// appendRow decodes a row image of the outbox table and adds it to the transaction
+// when it awaits handling. Images of claimed or finished records are skipped, and a
+// lease that expires is left to the sweeper. Rows that cannot be decoded are logged
+// and skipped; the sweeper picks them up from the table if they still need handling.
+func (stream *MySqlBinlogStream) appendRow(ctx context.Context, transaction []*Outbox, event *replication.RowsEvent, row int) []*Outbox {
+	outbox, err := stream.decodeRow(ctx, event, row)
+	if err != nil {
+		slog.Error("Error decoding outbox row from the binlog", "error", err)
+		return transaction
+	}
+	if outbox == nil || !awaitsHandling(outbox) {
+		return transaction
+	}
+	return append(transaction, outbox)
+}
+
+// decodeRow decodes a row image. Columns left out of the image, e.g. with
+// binlog_row_image=MINIMAL, make it read the record from the table instead; it is
+// nil when the record no longer exists.
+func (stream *MySqlBinlogStream) decodeRow(ctx context.Context, event *replication.RowsEvent, row int) (*Outbox, error) {
+	columns, err := stream.columnNames(ctx, event.Table)
+	if err != nil {
+		return nil, err
+	}
+	values := event.Rows[row]
+	var outbox Outbox
+	var headers, history []byte
+	for i, value := range values {
+		if i >= len(columns) {
+			break
+		}
+		switch columns[i] {
+		case "id":
+			outbox.Id, err = mySqlString(value)
+		case "name":
+			outbox.Name, err = mySqlString(value)
+		case "ordering_key":
+			outbox.OrderingKey, err = mySqlString(value)
+		case "payload":
+			outbox.Payload, err = mySqlString(value)
+		case "headers":
+			headers, err = mySqlBytes(value)
+		case "status":
+			outbox.Status, err = mySqlString(value)
+		case "created_at":
+			var createdAt *time.Time
+			if createdAt, err = mySqlTime(value); createdAt != nil {
+				outbox.CreatedAt = *createdAt
+			}
+		case "processed_at":
+			outbox.ProcessedAt, err = mySqlTime(value)
+		case "last_attempt_time":
+			outbox.LastAttemptTime, err = mySqlTime(value)
+		case "attempts":
+			var attempts int64
+			attempts, err = mySqlInt(value)
+			outbox.Attempts = int(attempts)
+		case "next_attempt_at":
+			outbox.NextAttemptAt, err = mySqlTime(value)
+		case "last_error":
+			outbox.LastError, err = mySqlString(value)
+		case "history":
+			history, err = mySqlBytes(value)
+		case "owner":
+			outbox.Owner, err = mySqlString(value)
+		case "lease_expires_at":
+			outbox.LeaseExpiresAt, err = mySqlTime(value)
+		case "version":
+			outbox.Version, err = mySqlInt(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding column %s: %w", columns[i], err)
+		}
+	}
+	if row < len(event.SkippedColumns) && len(event.SkippedColumns[row]) > 0 {
+		return stream.outboxRepository.Get(ctx, outbox.Id)
+	}
+	if len(headers) > 0 {
+		if err := json.Unmarshal(headers, &outbox.Headers); err != nil {
+			return nil, fmt.Errorf("invalid headers of outbox record %s: %w", outbox.Id, err)
+		}
+	}
+	if len(history) > 0 {
+		if err := json.Unmarshal(history, &outbox.History); err != nil {
+			return nil, fmt.Errorf("invalid history of outbox record %s: %w", outbox.Id, err)
+		}
+	}
+	return &outbox, nil
+}
+
+// columnNames returns the column names of the outbox table in binlog order, from
+// the binlog when it carries them, or from information_schema, cached until the
+// number of columns changes.
+func (stream *MySqlBinlogStream) columnNames(ctx context.Context, table *replication.TableMapEvent) ([]string, error) {
+	if names := table.ColumnNameString(); len(names) > 0 {
+		return names, nil
+	}
+	if len(stream.columns) == int(table.ColumnCount) {
+		return stream.columns, nil
+	}
+	rows, err := stream.db.QueryContext(ctx, `SELECT COLUMN_NAME FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?
+		ORDER BY ORDINAL_POSITION`,
+		stream.config.DBName, stream.tableName,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("reading columns of %s: %w", stream.tableName, err)
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	stream.columns = columns
+	return columns, nil
+}
+
+func mySqlString(value any) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case []byte:
+		return string(value), nil
+	}
+	return "", fmt.Errorf("unexpected %T value", value)
+}
+
+func mySqlBytes(value any) ([]byte, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []byte(value), nil
+	case []byte:
+		return value, nil
+	}
+	return nil, fmt.Errorf("unexpected %T value", value)
+}
+
+func mySqlInt(value any) (int64, error) {
+	switch value := value.(type) {
+	case nil:
+		return 0, nil
+	case int8:
+		return int64(value), nil
+	case int16:
+		return int64(value), nil
+	case int32:
+		return int64(value), nil
+	case int64:
+		return value, nil
+	}
+	return 0, fmt.Errorf("unexpected %T value", value)
+}
+
+// mySqlTime converts a DATETIME value, which the binlog carries without a time
+// zone; the columns hold UTC.
+func mySqlTime(value any) (*time.Time, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case time.Time:
+		utc := time.Date(value.Year(), value.Month(), value.Day(), value.Hour(), value.Minute(), value.Second(), value.Nanosecond(), time.UTC)
+		return &utc, nil
+	}
+	return nil, fmt.Errorf("unexpected %T value", value)
+}
+
+// isMySqlFatal reports errors reconnecting does not fix: bad credentials, missing
+// replication privileges or a position whose binlog has been purged.
+func isMySqlFatal(err error) bool {
+	var mySqlErr *mysql.MyError
+	if !errors.As(err, &mySqlErr) {
+		return false
+	}
+	switch mySqlErr.Code {
+	case mysql.ER_ACCESS_DENIED_ERROR, mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR, mysql.ER_MASTER_FATAL_ERROR_READING_BINLOG:
+		return true
+	}
+	return false
+}
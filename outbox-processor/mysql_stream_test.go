@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"testing"
+	"time"
+)
+
+func TestMySqlBinlogAppendsRowsAwaitingHandling(t *testing.T) {
+	columns := []string{"id", "status", "lease_expires_at", "version"}
+	stream := &MySqlBinlogStream{tableName: "outbox_events", columns: columns}
+	// DATETIME values are decoded in the local zone and read back as UTC.
+	now := time.Now().UTC()
+	local := func(at time.Time) time.Time {
+		return time.Date(at.Year(), at.Month(), at.Day(), at.Hour(), at.Minute(), at.Second(), at.Nanosecond(), time.Local)
+	}
+	for _, test := range []struct {
+		name     string
+		status   string
+		lease    any
+		appended bool
+	}{
+		{name: "pending", status: OutboxStatusPending, appended: true},
+		{name: "failed", status: OutboxStatusError, appended: true},
+		{name: "claimed", status: OutboxStatusInProgress, lease: local(now.Add(time.Minute))},
+		{name: "claim expired", status: OutboxStatusInProgress, lease: local(now.Add(-time.Minute)), appended: true},
+		{name: "processed", status: OutboxStatusProcessed},
+		{name: "dead", status: OutboxStatusDead},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			event := &replication.RowsEvent{
+				Table: &replication.TableMapEvent{ColumnCount: uint64(len(columns))},
+				Rows:  [][]any{{"1", test.status, test.lease, int64(3)}},
+			}
+
+			transaction := stream.appendRow(context.Background(), nil, event, 0)
+
+			if appended := len(transaction) == 1; appended != test.appended {
+				t.Fatalf("appended = %v, want %v", appended, test.appended)
+			}
+			if test.appended && (transaction[0].Id != "1" || transaction[0].Status != test.status || transaction[0].Version != 3) {
+				t.Errorf("decoded %+v", transaction[0])
+			}
+		})
+	}
+}
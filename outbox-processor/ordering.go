@@ -0,0 +1,32 @@
+package main
+
+import "time"
+
+const DefaultOrderingRecheckDelay = time.Second
+
+// OrderingPolicy keeps records sharing an ordering key, such as the purchase an
+// event belongs to, in creation order: they are handled by the same worker, and a
+// record waits while an earlier one of its key is still pending or in retry.
+// Events listed in Unordered opt out and are handled as soon as they are due.
+type OrderingPolicy struct {
+	Unordered    map[string]bool
+	RecheckDelay time.Duration
+}
+
+func DefaultOrderingPolicy() OrderingPolicy {
+	return OrderingPolicy{Unordered: map[string]bool{}, RecheckDelay: DefaultOrderingRecheckDelay}
+}
+
+// Ordered reports whether the record has to wait for the earlier records of its key.
+func (p OrderingPolicy) Ordered(outbox *Outbox) bool {
+	return outbox.OrderingKey != "" && !p.Unordered[outbox.Name]
+}
+
+// RoutingKey returns the key records are spread over workers by: the ordering key
+// for ordered records, so they are handled one at a time, and the id otherwise.
+func (p OrderingPolicy) RoutingKey(outbox *Outbox) string {
+	if p.Ordered(outbox) {
+		return outbox.OrderingKey
+	}
+	return outbox.Id
+}
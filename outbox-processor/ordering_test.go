@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOrderingPolicy(t *testing.T) {
+	policy := OrderingPolicy{Unordered: map[string]bool{"PAYMENT_AUDITED": true}}
+	for _, test := range []struct {
+		name       string
+		outbox     *Outbox
+		ordered    bool
+		routingKey string
+	}{
+		{name: "keyed", outbox: &Outbox{Id: "1", Name: "PAYMENT_PROCESSED", OrderingKey: "purchase"}, ordered: true, routingKey: "purchase"},
+		{name: "without key", outbox: &Outbox{Id: "1", Name: "PAYMENT_PROCESSED"}, routingKey: "1"},
+		{name: "opted out", outbox: &Outbox{Id: "1", Name: "PAYMENT_AUDITED", OrderingKey: "purchase"}, routingKey: "1"},
+	} {
+		if got := policy.Ordered(test.outbox); got != test.ordered {
+			t.Errorf("%s: Ordered = %v, want %v", test.name, got, test.ordered)
+		}
+		if got := policy.RoutingKey(test.outbox); got != test.routingKey {
+			t.Errorf("%s: RoutingKey = %q, want %q", test.name, got, test.routingKey)
+		}
+	}
+}
+
+func orderedOutbox(id, key string, createdAt time.Time) *Outbox {
+	outbox := claimedOutbox(id, 0)
+	outbox.OrderingKey = key
+	outbox.CreatedAt = createdAt
+	return outbox
+}
+
+func TestHandlerEmitsRecordsOfAKeyInCreationOrder(t *testing.T) {
+	now := time.Now()
+	first := orderedOutbox("1", "purchase", now)
+	second := orderedOutbox("2", "purchase", now.Add(time.Second))
+	other := orderedOutbox("3", "other", now.Add(time.Second))
+	repository := newMemoryOutboxRepository(first, second, other)
+	emitter := &recordingEmitter{}
+
+	newTestHandler(repository, emitter, nil).HandleBatch(context.Background(), []*Outbox{first, second, other})
+
+	var emitted []string
+	for _, event := range emitter.emitted {
+		emitted = append(emitted, event.ID)
+	}
+	if len(emitted) != 3 || emitted[0] != "1" || emitted[2] != "2" {
+		t.Errorf("emitted %v, want 1 and 3 before 2", emitted)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		if stored := repository.stored(id); stored.Status != OutboxStatusProcessed {
+			t.Errorf("record %s is %s, want %s", id, stored.Status, OutboxStatusProcessed)
+		}
+	}
+}
+
+func TestHandlerStopsAKeyBehindAFailedRecord(t *testing.T) {
+	now := time.Now()
+	first := orderedOutbox("1", "purchase", now)
+	second := orderedOutbox("2", "purchase", now.Add(time.Second))
+	repository := newMemoryOutboxRepository(first, second)
+	emitter := &recordingEmitter{failures: map[string]error{"1": errors.New("unavailable")}}
+
+	newTestHandler(repository, emitter, nil).HandleBatch(context.Background(), []*Outbox{first, second})
+
+	failed := repository.stored("1")
+	postponed := repository.stored("2")
+	if failed.Status != OutboxStatusError {
+		t.Fatalf("record 1 is %s, want %s", failed.Status, OutboxStatusError)
+	}
+	if postponed.Status != OutboxStatusPending || postponed.Attempts != 0 {
+		t.Errorf("record 2 is %s after %d attempts, want %s without an attempt", postponed.Status, postponed.Attempts, OutboxStatusPending)
+	}
+	// The record waits for the next attempt of the one it follows rather than polling.
+	if postponed.NextAttemptAt == nil || postponed.NextAttemptAt.Before(*failed.NextAttemptAt) {
+		t.Errorf("record 2 is next attempted at %v, before record 1 at %v", postponed.NextAttemptAt, failed.NextAttemptAt)
+	}
+	if len(emitter.emitted) != 0 {
+		t.Errorf("emitted %d events, want none", len(emitter.emitted))
+	}
+}
+
+func TestHandlerDoesNotHoldUnorderedOrBehindDeadRecords(t *testing.T) {
+	now := time.Now()
+	dead := orderedOutbox("1", "purchase", now)
+	dead.MarkAsDead(errors.New("poison"))
+	afterDead := orderedOutbox("2", "purchase", now.Add(time.Second))
+	pending := orderedOutbox("3", "refund", now)
+	pending.Status = OutboxStatusPending
+	audit := orderedOutbox("4", "refund", now.Add(time.Second))
+	audit.Name = "PAYMENT_AUDITED"
+	repository := newMemoryOutboxRepository(dead, afterDead, pending, audit)
+	emitter := &recordingEmitter{}
+	handler := newTestHandler(repository, emitter, nil)
+	handler.ordering.Unordered = map[string]bool{"PAYMENT_AUDITED": true}
+
+	handler.HandleBatch(context.Background(), []*Outbox{afterDead, audit})
+
+	if len(emitter.emitted) != 2 {
+		t.Errorf("emitted %d events, want the one behind a dead record and the unordered one", len(emitter.emitted))
+	}
+}
+
+func TestOutboxPostponeKeepsAttempts(t *testing.T) {
+	outbox := claimedOutbox("1", 2)
+	until := time.Now().Add(time.Minute)
+	outbox.Postpone(until)
+
+	if outbox.Status != OutboxStatusPending || outbox.Attempts != 2 || !outbox.NextAttemptAt.Equal(until) {
+		t.Errorf("postponed record is %s after %d attempts until %v", outbox.Status, outbox.Attempts, outbox.NextAttemptAt)
+	}
+	if outbox.Owner != "" || outbox.LeaseExpiresAt != nil {
+		t.Errorf("claim of %s is still held", outbox.Owner)
+	}
+}
+
+func TestWorkerPoolKeepsAKeyOnOneWorkerInOrder(t *testing.T) {
+	var mutex sync.Mutex
+	seen := map[string][]int{}
+	pool := NewWorkerPool(4, 8, 1, time.Millisecond, DefaultOrderingPolicy(), func(_ context.Context, outboxes []*Outbox) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, outbox := range outboxes {
+			sequence, _ := strconv.Atoi(outbox.Id)
+			seen[outbox.OrderingKey] = append(seen[outbox.OrderingKey], sequence)
+		}
+	})
+	events := make(chan *Outbox)
+	go func() {
+		for i := range 60 {
+			events <- &Outbox{Id: strconv.Itoa(i), OrderingKey: "purchase-" + strconv.Itoa(i%3)}
+		}
+		close(events)
+	}()
+
+	pool.Run(context.Background(), events)
+
+	for key, sequences := range seen {
+		for i := 1; i < len(sequences); i++ {
+			if sequences[i] < sequences[i-1] {
+				t.Errorf("%s handled out of order: %v", key, sequences)
+				break
+			}
+		}
+	}
+}
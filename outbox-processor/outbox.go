@@ -2,29 +2,81 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"time"
 )
 
+const (
+	OutboxStatusPending    = "PENDING"
+	OutboxStatusInProgress = "IN_PROGRESS"
+	OutboxStatusProcessed  = "PROCESSED"
+	OutboxStatusError      = "ERROR"
+	OutboxStatusDead       = "DEAD"
+)
+
+const (
+	StatusIndexName      = "StatusIndex"
+	OrderingKeyIndexName = "OrderingKeyIndex"
+
+	// maxTransactItems is the most items DynamoDB accepts in one TransactWriteItems call.
+	maxTransactItems = 100
+)
+
+var ErrConcurrentModification = errors.New("outbox record was modified concurrently")
+
 type (
 	Outbox struct {
-		Id              string     `json:"id" bson:"_id"`
-		Name            string     `json:"name" bson:"name"`
-		Payload         string     `json:"payload" bson:"payload"`
-		Status          string     `json:"status" bson:"status"`
-		CreatedAt       time.Time  `json:"created_at" bson:"created_at"`
-		ProcessedAt     *time.Time `json:"processed_at" bson:"processed_at"`
-		LastAttemptTime *time.Time `json:"last_attempt_time" bson:"last_attempt_time"`
+		Id              string            `json:"id" bson:"_id"`
+		Name            string            `json:"name" bson:"name"`
+		OrderingKey     string            `json:"ordering_key,omitempty" bson:"ordering_key,omitempty"`
+		Payload         string            `json:"payload" bson:"payload"`
+		Headers         map[string]string `json:"headers,omitempty" bson:"headers,omitempty"`
+		Status          string            `json:"status" bson:"status"`
+		CreatedAt       time.Time         `json:"created_at" bson:"created_at"`
+		ProcessedAt     *time.Time        `json:"processed_at" bson:"processed_at"`
+		LastAttemptTime *time.Time        `json:"last_attempt_time" bson:"last_attempt_time"`
+		Attempts        int               `json:"attempts" bson:"attempts"`
+		NextAttemptAt   *time.Time        `json:"next_attempt_at" bson:"next_attempt_at"`
+		LastError       string            `json:"last_error,omitempty" bson:"last_error,omitempty"`
+		History         []Attempt         `json:"history,omitempty" bson:"history,omitempty"`
+		Owner           string            `json:"owner,omitempty" bson:"owner,omitempty"`
+		LeaseExpiresAt  *time.Time        `json:"lease_expires_at,omitempty" bson:"lease_expires_at,omitempty" dynamodbav:"lease_expires_at,omitempty,unixtime"`
+		Version         int64             `json:"version" bson:"version"`
+	}
+
+	Attempt struct {
+		At    time.Time `json:"at" bson:"at"`
+		Error string    `json:"error" bson:"error"`
 	}
 
 	OutboxRepository interface {
-		Update(outbox *Outbox) error
-		Get(id string) (*Outbox, error)
+		// Update persists the record only if it still has the version it was read with,
+		// failing with ErrConcurrentModification otherwise, and bumps its version.
+		Update(ctx context.Context, outbox *Outbox) error
+		// UpdateBatch updates several records like Update, returning one result per record.
+		UpdateBatch(ctx context.Context, outboxes []*Outbox) []error
+		Get(ctx context.Context, id string) (*Outbox, error)
+		// Claim atomically moves a PENDING, ERROR or lease-expired IN_PROGRESS record to
+		// IN_PROGRESS on behalf of owner until the lease expires, and returns the claimed
+		// copy without reading it back. The claim only succeeds while the stored record
+		// still has the version of the given one; it returns nil when the record changed
+		// since, e.g. because another replica owns it, or is not claimable.
+		Claim(ctx context.Context, outbox *Outbox, owner string, lease time.Duration) (*Outbox, error)
+		// FindStuck returns up to limit records that should have been handled before the
+		// given time but are still waiting, e.g. because their change notification was lost.
+		FindStuck(ctx context.Context, before time.Time, limit int) ([]*Outbox, error)
+		// FindUnfinishedBefore returns the oldest record of the same ordering key created
+		// before the given one that is not finished yet, or nil when there is none.
+		FindUnfinishedBefore(ctx context.Context, outbox *Outbox) (*Outbox, error)
 	}
 
 	DynamoOutboxRepository struct {
@@ -37,16 +89,127 @@ type (
 	}
 )
 
-func (o *Outbox) MarkAsError() {
-	o.Status = "ERROR"
+func (o *Outbox) MarkAsError(retryPolicy RetryPolicy, err error) {
+	now := time.Now()
+	o.Attempts++
+	o.LastAttemptTime = &now
+	o.recordFailure(now, err)
+	o.release()
+	if retryPolicy.Exhausted(o.Attempts) {
+		o.Status = OutboxStatusDead
+		o.NextAttemptAt = nil
+		return
+	}
+	o.scheduleNextAttempt(now, retryPolicy)
+}
+
+func (o *Outbox) scheduleNextAttempt(now time.Time, retryPolicy RetryPolicy) {
+	o.Status = OutboxStatusError
+	nextAttemptAt := now.Add(retryPolicy.Backoff(o.Attempts))
+	o.NextAttemptAt = &nextAttemptAt
+}
+
+func (o *Outbox) MarkAsDead(err error) {
+	o.Status = OutboxStatusDead
 	now := time.Now()
+	o.Attempts++
 	o.LastAttemptTime = &now
+	o.NextAttemptAt = nil
+	o.recordFailure(now, err)
+	o.release()
+}
+
+// Postpone hands the record back without counting an attempt, to be picked up
+// again once the given time has passed.
+func (o *Outbox) Postpone(until time.Time) {
+	o.Status = OutboxStatusPending
+	o.NextAttemptAt = &until
+	o.release()
+}
+
+// Redrive puts a dead record back in the queue with a fresh retry budget. The
+// attempt history is kept so earlier failures remain visible.
+func (o *Outbox) Redrive() {
+	o.Status = OutboxStatusPending
+	o.Attempts = 0
+	o.NextAttemptAt = nil
+	o.ProcessedAt = nil
+	o.release()
+}
+
+func (o *Outbox) recordFailure(at time.Time, err error) {
+	o.LastError = err.Error()
+	o.History = append(o.History, Attempt{At: at, Error: o.LastError})
 }
 
 func (o *Outbox) MarkAsProcessed() {
-	o.Status = "PROCESSED"
+	o.Status = OutboxStatusProcessed
 	now := time.Now()
+	o.Attempts++
 	o.ProcessedAt = &now
+	o.LastAttemptTime = &now
+	o.NextAttemptAt = nil
+	o.release()
+}
+
+// claimedBy returns a copy of the record as stored once claimed by owner until the given time.
+func (o *Outbox) claimedBy(owner string, until time.Time) *Outbox {
+	claimed := *o
+	claimed.Status = OutboxStatusInProgress
+	claimed.Owner = owner
+	claimed.LeaseExpiresAt = &until
+	claimed.Version++
+	return &claimed
+}
+
+// release drops the claim held on the record by the replica that handled it.
+func (o *Outbox) release() {
+	o.Owner = ""
+	o.LeaseExpiresAt = nil
+}
+
+// event decodes the event the record carries. CreatedAt and Headers, such as the
+// producer's trace context, are taken from the record itself.
+func (o *Outbox) event() (*Event, error) {
+	var event Event
+	if err := json.Unmarshal([]byte(o.Payload), &event); err != nil {
+		return nil, err
+	}
+	event.CreatedAt = o.CreatedAt
+	event.Headers = o.Headers
+	return &event, nil
+}
+
+// IsFinished reports whether the record reached a status it never leaves on its own.
+func (o *Outbox) IsFinished() bool {
+	return o.Status == OutboxStatusProcessed || o.Status == OutboxStatusDead
+}
+
+// IsClaimable reports whether Claim can take the record over at now: it is pending,
+// failed, or claimed under a lease that has expired.
+func (o *Outbox) IsClaimable(now time.Time) bool {
+	switch o.Status {
+	case OutboxStatusPending, OutboxStatusError:
+		return true
+	case OutboxStatusInProgress:
+		return o.LeaseExpiresAt == nil || o.LeaseExpiresAt.Before(now)
+	}
+	return false
+}
+
+// IsStuck reports whether the record should have been handled already: pending since
+// before the given time, failed with a next attempt due before it, or claimed under a
+// lease that has expired by now.
+func (o *Outbox) IsStuck(before, now time.Time) bool {
+	switch o.Status {
+	case OutboxStatusPending:
+		return o.CreatedAt.Before(before) && (o.NextAttemptAt == nil || o.NextAttemptAt.Before(before))
+	case OutboxStatusError:
+		return o.NextAttemptAt == nil || o.NextAttemptAt.Before(before)
+	case OutboxStatusInProgress:
+		return o.LeaseExpiresAt == nil || o.LeaseExpiresAt.Before(now)
+	}
+	return false
 }
 
 func NewMongoOutboxRepository(collection *mongo.Collection) *MongoOutboxRepository {
@@ -57,35 +220,126 @@ func NewDynamoOutboxRepository(dynamoClient *dynamodb.DynamoDB, tableName string
 	return &DynamoOutboxRepository{dynamoClient: dynamoClient, tableName: tableName}
 }
 
-func (r *DynamoOutboxRepository) Update(outbox *Outbox) error {
-	key, err := dynamodbattribute.MarshalMap(map[string]string{"id": outbox.Id})
+func (r *DynamoOutboxRepository) Update(ctx context.Context, outbox *Outbox) error {
+	update, err := r.update(outbox)
+	if err != nil {
+		return err
+	}
+	_, err = r.dynamoClient.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 update.TableName,
+		Key:                       update.Key,
+		ConditionExpression:       update.ConditionExpression,
+		ExpressionAttributeNames:  update.ExpressionAttributeNames,
+		ExpressionAttributeValues: update.ExpressionAttributeValues,
+		UpdateExpression:          update.UpdateExpression,
+	})
+	if isConditionalCheckFailed(err) {
+		return ErrConcurrentModification
+	}
 	if err != nil {
 		return err
 	}
+	outbox.Version++
+	return nil
+}
+
+// UpdateBatch writes the records in transactions of up to maxTransactItems updates.
+// BatchWriteItem cannot carry the version condition, so it is not used. When a
+// transaction is cancelled, records whose condition failed are reported as
+// concurrently modified and the others are updated one by one.
+func (r *DynamoOutboxRepository) UpdateBatch(ctx context.Context, outboxes []*Outbox) []error {
+	errs := make([]error, len(outboxes))
+	for start := 0; start < len(outboxes); start += maxTransactItems {
+		end := min(start+maxTransactItems, len(outboxes))
+		r.updateTransaction(ctx, outboxes[start:end], errs[start:end])
+	}
+	return errs
+}
+
+func (r *DynamoOutboxRepository) updateTransaction(ctx context.Context, outboxes []*Outbox, errs []error) {
+	items := make([]*dynamodb.TransactWriteItem, 0, len(outboxes))
+	for i, outbox := range outboxes {
+		update, err := r.update(outbox)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		items = append(items, &dynamodb.TransactWriteItem{Update: update})
+	}
+	if len(items) != len(outboxes) {
+		// Transactions need every item, so fall back to the ones that could be built.
+		for i, outbox := range outboxes {
+			if errs[i] == nil {
+				errs[i] = r.Update(ctx, outbox)
+			}
+		}
+		return
+	}
+	_, err := r.dynamoClient.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err == nil {
+		for _, outbox := range outboxes {
+			outbox.Version++
+		}
+		return
+	}
+	var cancelled *dynamodb.TransactionCanceledException
+	if !errors.As(err, &cancelled) || len(cancelled.CancellationReasons) != len(outboxes) {
+		for i := range errs {
+			errs[i] = err
+		}
+		return
+	}
+	for i, reason := range cancelled.CancellationReasons {
+		if aws.StringValue(reason.Code) == "ConditionalCheckFailed" {
+			errs[i] = ErrConcurrentModification
+		} else {
+			errs[i] = r.Update(ctx, outboxes[i])
+		}
+	}
+}
+
+// update builds the conditional update persisting a record at its current version.
+func (r *DynamoOutboxRepository) update(outbox *Outbox) (*dynamodb.Update, error) {
+	key, err := dynamodbattribute.MarshalMap(map[string]string{"id": outbox.Id})
+	if err != nil {
+		return nil, err
+	}
 	update := expression.Set(expression.Name("status"), expression.Value(outbox.Status))
 	update.Set(expression.Name("processed_at"), expression.Value(outbox.ProcessedAt))
 	update.Set(expression.Name("last_attempt_time"), expression.Value(outbox.LastAttemptTime))
-	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	update.Set(expression.Name("attempts"), expression.Value(outbox.Attempts))
+	update.Set(expression.Name("next_attempt_at"), expression.Value(outbox.NextAttemptAt))
+	update.Set(expression.Name("last_error"), expression.Value(outbox.LastError))
+	update.Set(expression.Name("history"), expression.Value(outbox.History))
+	if outbox.LeaseExpiresAt == nil {
+		update.Remove(expression.Name("owner"))
+		update.Remove(expression.Name("lease_expires_at"))
+	} else {
+		update.Set(expression.Name("owner"), expression.Value(outbox.Owner))
+		update.Set(expression.Name("lease_expires_at"), expression.Value(outbox.LeaseExpiresAt.Unix()))
+	}
+	update.Set(expression.Name("version"), expression.Value(outbox.Version+1))
+	condition := expression.AttributeExists(expression.Name("id")).And(dynamoVersionCondition(outbox.Version))
+	expr, err := expression.NewBuilder().WithCondition(condition).WithUpdate(update).Build()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	input := &dynamodb.UpdateItemInput{
+	return &dynamodb.Update{
 		TableName:                 aws.String(r.tableName),
 		Key:                       key,
+		ConditionExpression:       expr.Condition(),
 		ExpressionAttributeNames:  expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
 		UpdateExpression:          expr.Update(),
-	}
-	_, err = r.dynamoClient.UpdateItem(input)
-	return err
+	}, nil
 }
 
-func (r *DynamoOutboxRepository) Get(id string) (*Outbox, error) {
+func (r *DynamoOutboxRepository) Get(ctx context.Context, id string) (*Outbox, error) {
 	key, err := dynamodbattribute.MarshalMap(map[string]string{"id": id})
 	if err != nil {
 		return nil, err
 	}
-	item, err := r.dynamoClient.GetItem(&dynamodb.GetItemInput{
+	item, err := r.dynamoClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(r.tableName),
 		Key:       key,
 	})
@@ -103,20 +357,108 @@ func (r *DynamoOutboxRepository) Get(id string) (*Outbox, error) {
 	return &outbox, nil
 }
 
-func (r *MongoOutboxRepository) Update(outbox *Outbox) error {
-	update := bson.M{
+func (r *MongoOutboxRepository) Update(ctx context.Context, outbox *Outbox) error {
+	result, err := r.collection.UpdateOne(ctx, mongoVersionedFilter(outbox), mongoUpdate(outbox))
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrConcurrentModification
+	}
+	outbox.Version++
+	return nil
+}
+
+// UpdateBatch sends the updates in one unordered BulkWrite. The result only counts the
+// matched documents, so when some did not match, the records are read back to find out
+// which ones were written: only those carry the new version and status.
+func (r *MongoOutboxRepository) UpdateBatch(ctx context.Context, outboxes []*Outbox) []error {
+	errs := make([]error, len(outboxes))
+	if len(outboxes) == 0 {
+		return errs
+	}
+	models := make([]mongo.WriteModel, len(outboxes))
+	ids := make(bson.A, len(outboxes))
+	for i, outbox := range outboxes {
+		models[i] = mongo.NewUpdateOneModel().SetFilter(mongoVersionedFilter(outbox)).SetUpdate(mongoUpdate(outbox))
+		ids[i] = outbox.Id
+	}
+	result, err := r.collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err == nil && result.MatchedCount == int64(len(outboxes)) {
+		for _, outbox := range outboxes {
+			outbox.Version++
+		}
+		return errs
+	}
+	var bulkErr mongo.BulkWriteException
+	if err != nil && !errors.As(err, &bulkErr) {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	failed := make(map[int]error)
+	for _, writeErr := range bulkErr.WriteErrors {
+		failed[writeErr.Index] = writeErr
+	}
+	cursor, err := r.collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"status": 1, "version": 1}))
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	var stored []*Outbox
+	if err := cursor.All(ctx, &stored); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	byId := make(map[string]*Outbox, len(stored))
+	for _, outbox := range stored {
+		byId[outbox.Id] = outbox
+	}
+	for i, outbox := range outboxes {
+		current := byId[outbox.Id]
+		switch {
+		case failed[i] != nil:
+			errs[i] = failed[i]
+		case current != nil && current.Version == outbox.Version+1 && current.Status == outbox.Status:
+			outbox.Version++
+		default:
+			errs[i] = ErrConcurrentModification
+		}
+	}
+	return errs
+}
+
+func mongoVersionedFilter(outbox *Outbox) bson.M {
+	return bson.M{"_id": outbox.Id, "version": mongoVersionFilter(outbox.Version)}
+}
+
+func mongoUpdate(outbox *Outbox) bson.M {
+	return bson.M{
 		"$set": bson.M{
 			"status":            outbox.Status,
 			"processed_at":      outbox.ProcessedAt,
 			"last_attempt_time": outbox.LastAttemptTime,
+			"attempts":          outbox.Attempts,
+			"next_attempt_at":   outbox.NextAttemptAt,
+			"last_error":        outbox.LastError,
+			"history":           outbox.History,
+			"owner":             outbox.Owner,
+			"lease_expires_at":  outbox.LeaseExpiresAt,
+			"version":           outbox.Version + 1,
 		},
 	}
-	_, err := r.collection.UpdateByID(context.TODO(), outbox.Id, update)
-	return err
 }
 
-func (r *MongoOutboxRepository) Get(id string) (*Outbox, error) {
-	result := r.collection.FindOne(context.TODO(), bson.M{"_id": id})
+func (r *MongoOutboxRepository) Get(ctx context.Context, id string) (*Outbox, error) {
+	result := r.collection.FindOne(ctx, bson.M{"_id": id})
+	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+		return nil, nil
+	}
 	if result.Err() != nil {
 		return nil, result.Err()
 	}
@@ -127,3 +469,251 @@ func (r *MongoOutboxRepository) Get(id string) (*Outbox, error) {
 	}
 	return &outbox, nil
 }
+
+func (r *DynamoOutboxRepository) Claim(ctx context.Context, outbox *Outbox, owner string, lease time.Duration) (*Outbox, error) {
+	key, err := dynamodbattribute.MarshalMap(map[string]string{"id": outbox.Id})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	claimed := outbox.claimedBy(owner, now.Add(lease))
+	claimable := expression.Name("status").In(expression.Value(OutboxStatusPending), expression.Value(OutboxStatusError))
+	// A claim without a lease, e.g. from before leases existed, counts as expired.
+	leaseExpired := expression.Name("status").Equal(expression.Value(OutboxStatusInProgress)).
+		And(expression.AttributeNotExists(expression.Name("lease_expires_at")).
+			Or(expression.Name("lease_expires_at").LessThan(expression.Value(now.Unix()))))
+	condition := expression.AttributeExists(expression.Name("id")).
+		And(claimable.Or(leaseExpired), dynamoVersionCondition(outbox.Version))
+	update := expression.Set(expression.Name("status"), expression.Value(claimed.Status))
+	update.Set(expression.Name("owner"), expression.Value(claimed.Owner))
+	update.Set(expression.Name("lease_expires_at"), expression.Value(claimed.LeaseExpiresAt.Unix()))
+	update.Set(expression.Name("version"), expression.Value(claimed.Version))
+	expr, err := expression.NewBuilder().WithCondition(condition).WithUpdate(update).Build()
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.dynamoClient.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.tableName),
+		Key:                       key,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+	})
+	if isConditionalCheckFailed(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+func (r *MongoOutboxRepository) Claim(ctx context.Context, outbox *Outbox, owner string, lease time.Duration) (*Outbox, error) {
+	now := time.Now()
+	claimed := outbox.claimedBy(owner, now.Add(lease))
+	filter := bson.M{
+		"_id":     outbox.Id,
+		"version": mongoVersionFilter(outbox.Version),
+		"$or": bson.A{
+			bson.M{"status": bson.M{"$in": bson.A{OutboxStatusPending, OutboxStatusError}}},
+			// A claim without a lease counts as expired.
+			bson.M{"status": OutboxStatusInProgress, "lease_expires_at": bson.M{"$not": bson.M{"$gte": now}}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"status":           claimed.Status,
+			"owner":            claimed.Owner,
+			"lease_expires_at": claimed.LeaseExpiresAt,
+			"version":          claimed.Version,
+		},
+	}
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, nil
+	}
+	return claimed, nil
+}
+
+// dynamoVersionCondition matches an item still at the given version. Items written
+// before versioning have no version attribute, which version 0 also matches.
+func dynamoVersionCondition(version int64) expression.ConditionBuilder {
+	condition := expression.Name("version").Equal(expression.Value(version))
+	if version == 0 {
+		condition = condition.Or(expression.AttributeNotExists(expression.Name("version")))
+	}
+	return condition
+}
+
+// mongoVersionFilter matches a document still at the given version. Records written
+// before versioning have no version field, which a null match covers.
+func mongoVersionFilter(version int64) any {
+	if version == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+	return version
+}
+
+func isConditionalCheckFailed(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// FindStuck queries the StatusIndex once per waiting status. Timestamps other than the
+// lease are stored as strings in the producer's time zone, so they are compared here
+// rather than in a filter expression; waiting records are expected to be few.
+func (r *DynamoOutboxRepository) FindStuck(ctx context.Context, before time.Time, limit int) ([]*Outbox, error) {
+	now := time.Now()
+	var stuck []*Outbox
+	for _, status := range []string{OutboxStatusPending, OutboxStatusError, OutboxStatusInProgress} {
+		builder := expression.NewBuilder().WithKeyCondition(expression.Key("status").Equal(expression.Value(status)))
+		if status == OutboxStatusInProgress {
+			// Claims without a lease, e.g. from before leases existed, count as expired.
+			builder = builder.WithFilter(expression.AttributeNotExists(expression.Name("lease_expires_at")).
+				Or(expression.Name("lease_expires_at").LessThan(expression.Value(now.Unix()))))
+		}
+		expr, err := builder.Build()
+		if err != nil {
+			return nil, err
+		}
+		input := &dynamodb.QueryInput{
+			TableName:                 aws.String(r.tableName),
+			IndexName:                 aws.String(StatusIndexName),
+			KeyConditionExpression:    expr.KeyCondition(),
+			FilterExpression:          expr.Filter(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		}
+		var unmarshalErr error
+		err = r.dynamoClient.QueryPagesWithContext(ctx, input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			var records []*Outbox
+			if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &records); unmarshalErr != nil {
+				return false
+			}
+			for _, record := range records {
+				if record.IsStuck(before, now) {
+					stuck = append(stuck, record)
+				}
+			}
+			return len(stuck) < limit
+		})
+		if err != nil {
+			return nil, err
+		}
+		if unmarshalErr != nil {
+			return nil, unmarshalErr
+		}
+		if len(stuck) >= limit {
+			return stuck[:limit], nil
+		}
+	}
+	return stuck, nil
+}
+
+func (r *MongoOutboxRepository) FindStuck(ctx context.Context, before time.Time, limit int) ([]*Outbox, error) {
+	filter := bson.M{"$or": bson.A{
+		bson.M{
+			"status":     OutboxStatusPending,
+			"created_at": bson.M{"$lt": before},
+			"$or":        bson.A{bson.M{"next_attempt_at": nil}, bson.M{"next_attempt_at": bson.M{"$lt": before}}},
+		},
+		bson.M{
+			"status": OutboxStatusError,
+			"$or":    bson.A{bson.M{"next_attempt_at": nil}, bson.M{"next_attempt_at": bson.M{"$lt": before}}},
+		},
+		bson.M{
+			"status": OutboxStatusInProgress,
+			"$or":    bson.A{bson.M{"lease_expires_at": nil}, bson.M{"lease_expires_at": bson.M{"$lt": time.Now()}}},
+		},
+	}}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var stuck []*Outbox
+	if err := cursor.All(ctx, &stuck); err != nil {
+		return nil, err
+	}
+	return stuck, nil
+}
+
+// FindUnfinishedBefore queries the OrderingKeyIndex. As in FindStuck, creation times are
+// compared here rather than in a filter expression since they are stored as strings.
+func (r *DynamoOutboxRepository) FindUnfinishedBefore(ctx context.Context, outbox *Outbox) (*Outbox, error) {
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("ordering_key").Equal(expression.Value(outbox.OrderingKey))).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(r.tableName),
+		IndexName:                 aws.String(OrderingKeyIndexName),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+	var earliest *Outbox
+	var unmarshalErr error
+	err = r.dynamoClient.QueryPagesWithContext(ctx, input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		var records []*Outbox
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &records); unmarshalErr != nil {
+			return false
+		}
+		for _, record := range records {
+			if record.IsFinished() || !record.CreatedAt.Before(outbox.CreatedAt) {
+				continue
+			}
+			if earliest == nil || record.CreatedAt.Before(earliest.CreatedAt) {
+				earliest = record
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return earliest, unmarshalErr
+}
+
+func (r *MongoOutboxRepository) FindUnfinishedBefore(ctx context.Context, outbox *Outbox) (*Outbox, error) {
+	filter := bson.M{
+		"ordering_key": outbox.OrderingKey,
+		"created_at":   bson.M{"$lt": outbox.CreatedAt},
+		"status":       bson.M{"$nin": bson.A{OutboxStatusProcessed, OutboxStatusDead}},
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	result := r.collection.FindOne(ctx, filter, opts)
+	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+	var earliest Outbox
+	if err := result.Decode(&earliest); err != nil {
+		return nil, err
+	}
+	return &earliest, nil
+}
+
+// EnsureIndexes creates the indexes FindStuck and FindUnfinishedBefore rely on to
+// avoid scanning the whole collection.
+func (r *MongoOutboxRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}},
+			Options: options.Index().SetName("status_created_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "ordering_key", Value: 1}, {Key: "created_at", Value: 1}},
+			Options: options.Index().SetName("ordering_key_created_at").SetSparse(true),
+		},
+	})
+	return err
+}
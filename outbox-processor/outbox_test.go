@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOutboxTransitions(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Minute, MaxBackoff: time.Hour}
+	failure := errors.New("broker unavailable")
+	lease := time.Now().Add(time.Minute)
+	for _, test := range []struct {
+		name          string
+		attempts      int
+		apply         func(*Outbox)
+		status        string
+		nextAttemptAt bool
+		lastError     string
+	}{
+		{name: "processed", apply: (*Outbox).MarkAsProcessed, status: OutboxStatusProcessed},
+		{name: "first failure", apply: func(o *Outbox) { o.MarkAsError(policy, failure) }, status: OutboxStatusError, nextAttemptAt: true, lastError: failure.Error()},
+		{name: "failure within budget", attempts: 1, apply: func(o *Outbox) { o.MarkAsError(policy, failure) }, status: OutboxStatusError, nextAttemptAt: true, lastError: failure.Error()},
+		{name: "failure exhausting budget", attempts: 2, apply: func(o *Outbox) { o.MarkAsError(policy, failure) }, status: OutboxStatusDead, lastError: failure.Error()},
+		{name: "dead", apply: func(o *Outbox) { o.MarkAsDead(failure) }, status: OutboxStatusDead, lastError: failure.Error()},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			outbox := &Outbox{Id: "1", Status: OutboxStatusInProgress, Attempts: test.attempts, Owner: "replica", LeaseExpiresAt: &lease}
+			test.apply(outbox)
+
+			if outbox.Status != test.status {
+				t.Errorf("status = %s, want %s", outbox.Status, test.status)
+			}
+			if outbox.Attempts != test.attempts+1 {
+				t.Errorf("attempts = %d, want %d", outbox.Attempts, test.attempts+1)
+			}
+			if outbox.LastAttemptTime == nil {
+				t.Error("last attempt time is not set")
+			}
+			if (outbox.NextAttemptAt != nil) != test.nextAttemptAt {
+				t.Errorf("next attempt at = %v, want set %v", outbox.NextAttemptAt, test.nextAttemptAt)
+			}
+			if outbox.LastError != test.lastError {
+				t.Errorf("last error = %q, want %q", outbox.LastError, test.lastError)
+			}
+			if outbox.Owner != "" || outbox.LeaseExpiresAt != nil {
+				t.Errorf("claim of %s is still held until %v", outbox.Owner, outbox.LeaseExpiresAt)
+			}
+		})
+	}
+}
+
+func TestOutboxMarkAsErrorSchedulesBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseBackoff: time.Minute, MaxBackoff: time.Hour}
+	outbox := &Outbox{Status: OutboxStatusInProgress, Attempts: 2}
+	before := time.Now()
+	outbox.MarkAsError(policy, errors.New("timeout"))
+
+	// The third failure waits for BaseBackoff doubled twice.
+	if want := before.Add(4 * time.Minute); outbox.NextAttemptAt.Before(want) || outbox.NextAttemptAt.After(want.Add(time.Second)) {
+		t.Errorf("next attempt at = %v, want about %v", outbox.NextAttemptAt, want)
+	}
+}
+
+func TestOutboxHistoryKeepsEveryFailure(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Second}
+	outbox := &Outbox{Status: OutboxStatusInProgress}
+	for _, message := range []string{"first", "second", "third"} {
+		outbox.MarkAsError(policy, errors.New(message))
+	}
+	if outbox.Status != OutboxStatusDead {
+		t.Fatalf("status = %s, want %s", outbox.Status, OutboxStatusDead)
+	}
+	if len(outbox.History) != 3 || outbox.History[0].Error != "first" || outbox.History[2].Error != "third" {
+		t.Errorf("history = %v, want the three failures in order", outbox.History)
+	}
+}
+
+func TestOutboxRedriveKeepsHistory(t *testing.T) {
+	outbox := &Outbox{Status: OutboxStatusInProgress, Attempts: 2}
+	outbox.MarkAsDead(errors.New("poison"))
+	outbox.Redrive()
+
+	if outbox.Status != OutboxStatusPending || outbox.Attempts != 0 || outbox.NextAttemptAt != nil {
+		t.Errorf("redriven record is %s after %d attempts, next at %v; want a fresh %s record", outbox.Status, outbox.Attempts, outbox.NextAttemptAt, OutboxStatusPending)
+	}
+	if len(outbox.History) != 1 || outbox.History[0].Error != "poison" {
+		t.Errorf("history = %v, want the failure that killed the record", outbox.History)
+	}
+}
+
+func TestOutboxIsClaimable(t *testing.T) {
+	now := time.Now()
+	expired := now.Add(-time.Second)
+	live := now.Add(time.Minute)
+	for _, test := range []struct {
+		name      string
+		outbox    Outbox
+		claimable bool
+	}{
+		{name: "pending", outbox: Outbox{Status: OutboxStatusPending}, claimable: true},
+		{name: "failed", outbox: Outbox{Status: OutboxStatusError}, claimable: true},
+		{name: "live claim", outbox: Outbox{Status: OutboxStatusInProgress, LeaseExpiresAt: &live}},
+		{name: "expired claim", outbox: Outbox{Status: OutboxStatusInProgress, LeaseExpiresAt: &expired}, claimable: true},
+		{name: "claim without lease", outbox: Outbox{Status: OutboxStatusInProgress}, claimable: true},
+		{name: "processed", outbox: Outbox{Status: OutboxStatusProcessed}},
+		{name: "dead", outbox: Outbox{Status: OutboxStatusDead}},
+	} {
+		if got := test.outbox.IsClaimable(now); got != test.claimable {
+			t.Errorf("%s: IsClaimable = %v, want %v", test.name, got, test.claimable)
+		}
+	}
+}
+
+func TestOutboxClaimedByLeavesRecordUntouched(t *testing.T) {
+	outbox := &Outbox{Id: "1", Status: OutboxStatusError, Version: 4}
+	until := time.Now().Add(time.Minute)
+	claimed := outbox.claimedBy("replica", until)
+
+	if claimed.Status != OutboxStatusInProgress || claimed.Owner != "replica" || !claimed.LeaseExpiresAt.Equal(until) || claimed.Version != 5 {
+		t.Errorf("claimed copy is %s by %q until %v at version %d", claimed.Status, claimed.Owner, claimed.LeaseExpiresAt, claimed.Version)
+	}
+	if outbox.Status != OutboxStatusError || outbox.Owner != "" || outbox.LeaseExpiresAt != nil || outbox.Version != 4 {
+		t.Errorf("original record changed to %s by %q at version %d", outbox.Status, outbox.Owner, outbox.Version)
+	}
+}
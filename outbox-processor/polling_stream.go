@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const (
+	DefaultPollInterval   = time.Second
+	DefaultClaimBatchSize = 100
+
+	// minPollWait keeps a record that is due but locked by another replica from
+	// turning the wait for it into a busy loop.
+	minPollWait = 100 * time.Millisecond
+)
+
+type (
+	// DueClaimer is implemented by repositories that can claim due records in bulk.
+	DueClaimer interface {
+		// ClaimDue claims up to limit records that are due, oldest first, on behalf of
+		// owner, skipping records another replica is claiming at the same time.
+		ClaimDue(ctx context.Context, owner string, lease time.Duration, limit int) ([]*Outbox, error)
+		// NextDueAt returns when the earliest record waiting for a retry, a postponed
+		// turn or an expired lease becomes due, or nil when no record is waiting.
+		NextDueAt(ctx context.Context) (*time.Time, error)
+	}
+
+	// Notifier wakes a PollingStream up as soon as records may be due, e.g. when the
+	// database signals a write, until ctx is done.
+	Notifier interface {
+		Listen(ctx context.Context, wake chan<- struct{})
+	}
+)
+
+// PollingStream polls a table for due records and claims each batch for this
+// replica before delivering it, so replicas sharing the table never hand out the
+// same record. A full batch is followed by another poll right away, anything less
+// by a wait of at most interval, cut short when a waiting record becomes due or
+// the notifier, if any, signals a write. With a notifier the interval only bounds
+// how late a lost notification is noticed, so it can be much longer.
+//
+// Records claimed but not delivered when the stream stops stay IN_PROGRESS until
+// their lease expires, after which any replica claims them again.
+type PollingStream struct {
+	claimer   DueClaimer
+	owner     string
+	lease     time.Duration
+	interval  time.Duration
+	batchSize int
+	notifier  Notifier
+	errors    chan error
+}
+
+// NewPollingStream creates a stream claiming records through claimer. The notifier may be nil.
+func NewPollingStream(claimer DueClaimer, owner string, lease, interval time.Duration, batchSize int, notifier Notifier) *PollingStream {
+	return &PollingStream{
+		claimer:   claimer,
+		owner:     owner,
+		lease:     lease,
+		interval:  interval,
+		batchSize: max(batchSize, 1),
+		notifier:  notifier,
+		errors:    make(chan error),
+	}
+}
+
+func (stream *PollingStream) FetchEvents(ctx context.Context) (chan *Outbox, error) {
+	var wake chan struct{}
+	if stream.notifier != nil {
+		wake = make(chan struct{}, 1)
+		go stream.notifier.Listen(ctx, wake)
+	}
+	events := newEventChannel(ctx)
+	events.goTracked(func() { stream.poll(ctx, events, wake) })
+	events.closeWhenDone()
+	return events.events, nil
+}
+
+// Errors never reports anything: a failed poll is logged and tried again after the interval.
+func (stream *PollingStream) Errors() <-chan error {
+	return stream.errors
+}
+
+func (stream *PollingStream) poll(ctx context.Context, events *eventChannel, wake <-chan struct{}) {
+	for {
+		claimed, err := stream.claimer.ClaimDue(ctx, stream.owner, stream.lease, stream.batchSize)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Error("Error claiming due outbox records", "error", err)
+		}
+		for _, outbox := range claimed {
+			if !events.send(outbox) {
+				return
+			}
+		}
+		if len(claimed) < stream.batchSize && !stream.wait(ctx, wake) {
+			return
+		}
+	}
+}
+
+// wait returns once the interval has passed, the next waiting record is due or a
+// notification arrived, reporting false when ctx is done first.
+func (stream *PollingStream) wait(ctx context.Context, wake <-chan struct{}) bool {
+	delay := stream.interval
+	dueAt, err := stream.claimer.NextDueAt(ctx)
+	if err != nil && ctx.Err() == nil {
+		slog.Error("Error looking up the next due outbox record", "error", err)
+	}
+	if dueAt != nil {
+		delay = min(delay, max(time.Until(*dueAt), minPollWait))
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-wake:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// notify wakes the poller up unless a wake-up is already pending.
+func notify(wake chan<- struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
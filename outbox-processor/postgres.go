@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"slices"
+	"strings"
+	"time"
+)
+
+type (
+	// PostgresOutboxRepository stores records in the table created by
+	// migrations/postgres. Optional text columns are NULL rather than empty.
+	PostgresOutboxRepository struct {
+		db        *sql.DB
+		tableName string
+	}
+
+	PostgresDeadLetterRepository struct {
+		db        *sql.DB
+		tableName string
+	}
+)
+
+func NewPostgresOutboxRepository(db *sql.DB, tableName string) *PostgresOutboxRepository {
+	return &PostgresOutboxRepository{db: db, tableName: pgx.Identifier{tableName}.Sanitize()}
+}
+
+func NewPostgresDeadLetterRepository(db *sql.DB, tableName string) DeadLetterRepository {
+	return &PostgresDeadLetterRepository{db: db, tableName: pgx.Identifier{tableName}.Sanitize()}
+}
+
+func (r *PostgresOutboxRepository) Update(ctx context.Context, outbox *Outbox) error {
+	if err := r.update(ctx, r.db, outbox); err != nil {
+		return err
+	}
+	outbox.Version++
+	return nil
+}
+
+// UpdateBatch runs the updates in one transaction, which saves a commit per record.
+// A record at another version does not abort the transaction, it only fails with
+// ErrConcurrentModification; any other error fails the whole batch.
+func (r *PostgresOutboxRepository) UpdateBatch(ctx context.Context, outboxes []*Outbox) []error {
+	errs := make([]error, len(outboxes))
+	if len(outboxes) == 0 {
+		return errs
+	}
+	failAll := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return failAll(err)
+	}
+	defer tx.Rollback()
+	for i, outbox := range outboxes {
+		err := r.update(ctx, tx, outbox)
+		if err != nil && !errors.Is(err, ErrConcurrentModification) {
+			return failAll(err)
+		}
+		errs[i] = err
+	}
+	if err := tx.Commit(); err != nil {
+		return failAll(err)
+	}
+	for i, outbox := range outboxes {
+		if errs[i] == nil {
+			outbox.Version++
+		}
+	}
+	return errs
+}
+
+func (r *PostgresOutboxRepository) update(ctx context.Context, db sqlExecutor, outbox *Outbox) error {
+	history, err := historyColumn(outbox.History)
+	if err != nil {
+		return err
+	}
+	result, err := db.ExecContext(ctx, `UPDATE `+r.tableName+` SET
+		status = $2, processed_at = $3, last_attempt_time = $4, attempts = $5, next_attempt_at = $6,
+		last_error = NULLIF($7, ''), history = $8, owner = NULLIF($9, ''), lease_expires_at = $10,
+		version = version + 1
+		WHERE id = $1 AND version = $11`,
+		outbox.Id, outbox.Status, outbox.ProcessedAt, outbox.LastAttemptTime, outbox.Attempts, outbox.NextAttemptAt,
+		outbox.LastError, history, outbox.Owner, outbox.LeaseExpiresAt, outbox.Version,
+	)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return ErrConcurrentModification
+	}
+	return nil
+}
+
+func (r *PostgresOutboxRepository) Get(ctx context.Context, id string) (*Outbox, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+sqlOutboxColumns+` FROM `+r.tableName+` WHERE id = $1`, id)
+	outbox, err := scanOutbox(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return outbox, err
+}
+
+// Claim also succeeds on a record owner already holds, at the same version, since
+// PollingStream claims the records before delivering them; the lease is renewed.
+func (r *PostgresOutboxRepository) Claim(ctx context.Context, outbox *Outbox, owner string, lease time.Duration) (*Outbox, error) {
+	now := time.Now()
+	claimed := outbox.claimedBy(owner, now.Add(lease))
+	result, err := r.db.ExecContext(ctx, `UPDATE `+r.tableName+` SET
+		status = $2, owner = $3, lease_expires_at = $4, version = version + 1
+		WHERE id = $1 AND version = $5 AND (
+			status IN ('`+OutboxStatusPending+`', '`+OutboxStatusError+`')
+			OR (status = '`+OutboxStatusInProgress+`' AND (lease_expires_at IS NULL OR lease_expires_at < $6 OR owner = $3))
+		)`,
+		outbox.Id, claimed.Status, claimed.Owner, claimed.LeaseExpiresAt, outbox.Version, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claimedRows, err := result.RowsAffected(); err != nil || claimedRows == 0 {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// ClaimDue claims up to limit records that are due, oldest first, on behalf of owner.
+// Rows locked by another replica's claim are skipped rather than waited for, so
+// replicas polling the same table never block each other or claim the same record.
+func (r *PostgresOutboxRepository) ClaimDue(ctx context.Context, owner string, lease time.Duration, limit int) ([]*Outbox, error) {
+	now := time.Now()
+	rows, err := r.db.QueryContext(ctx, `UPDATE `+r.tableName+` SET
+		status = '`+OutboxStatusInProgress+`', owner = $2, lease_expires_at = $3, version = version + 1
+		WHERE id IN (
+			SELECT id FROM `+r.tableName+`
+			WHERE (status IN ('`+OutboxStatusPending+`', '`+OutboxStatusError+`') AND (next_attempt_at IS NULL OR next_attempt_at <= $1))
+				OR (status = '`+OutboxStatusInProgress+`' AND (lease_expires_at IS NULL OR lease_expires_at < $1))
+			ORDER BY created_at
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+sqlOutboxColumns,
+		now, owner, now.Add(lease), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	claimed, err := scanOutboxes(rows)
+	if err != nil {
+		return nil, err
+	}
+	// RETURNING does not keep the order of the subquery.
+	slices.SortFunc(claimed, func(a, b *Outbox) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return claimed, nil
+}
+
+// NextDueAt returns when the earliest record waiting for a retry, a postponed turn
+// or an expired lease becomes due, or nil when no record is waiting.
+func (r *PostgresOutboxRepository) NextDueAt(ctx context.Context) (*time.Time, error) {
+	var dueAt *time.Time
+	err := r.db.QueryRowContext(ctx, `SELECT MIN(CASE
+			WHEN status = '`+OutboxStatusInProgress+`' THEN lease_expires_at
+			ELSE COALESCE(next_attempt_at, created_at)
+		END) FROM `+r.tableName+`
+		WHERE status IN ('`+OutboxStatusPending+`', '`+OutboxStatusError+`', '`+OutboxStatusInProgress+`')`,
+	).Scan(&dueAt)
+	return dueAt, err
+}
+
+func (r *PostgresOutboxRepository) FindStuck(ctx context.Context, before time.Time, limit int) ([]*Outbox, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+sqlOutboxColumns+` FROM `+r.tableName+`
+		WHERE (status = '`+OutboxStatusPending+`' AND created_at < $1 AND (next_attempt_at IS NULL OR next_attempt_at < $1))
+			OR (status = '`+OutboxStatusError+`' AND (next_attempt_at IS NULL OR next_attempt_at < $1))
+			OR (status = '`+OutboxStatusInProgress+`' AND (lease_expires_at IS NULL OR lease_expires_at < $2))
+		ORDER BY created_at
+		LIMIT $3`,
+		before, time.Now(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanOutboxes(rows)
+}
+
+func (r *PostgresOutboxRepository) FindUnfinishedBefore(ctx context.Context, outbox *Outbox) (*Outbox, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+sqlOutboxColumns+` FROM `+r.tableName+`
+		WHERE ordering_key = $1 AND created_at < $2
+			AND status NOT IN ('`+OutboxStatusProcessed+`', '`+OutboxStatusDead+`')
+		ORDER BY created_at
+		LIMIT 1`,
+		outbox.OrderingKey, outbox.CreatedAt,
+	)
+	earliest, err := scanOutbox(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return earliest, err
+}
+
+func (r *PostgresDeadLetterRepository) Send(ctx context.Context, deadLetter *DeadLetter) error {
+	history, err := historyColumn(deadLetter.History)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, `INSERT INTO `+r.tableName+`
+		(id, name, payload, created_at, dead_at, attempts, last_error, history, emitter)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO UPDATE SET
+			name = excluded.name, payload = excluded.payload, created_at = excluded.created_at,
+			dead_at = excluded.dead_at, attempts = excluded.attempts, last_error = excluded.last_error,
+			history = excluded.history, emitter = excluded.emitter`,
+		deadLetter.Id, deadLetter.Name, deadLetter.Payload, deadLetter.CreatedAt, deadLetter.DeadAt,
+		deadLetter.Attempts, deadLetter.LastError, history, deadLetter.Emitter,
+	)
+	return err
+}
+
+func (r *PostgresDeadLetterRepository) Find(ctx context.Context, filter DeadLetterFilter) ([]*DeadLetter, error) {
+	var conditions []string
+	var args []any
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if len(filter.Ids) > 0 {
+		where("id = ANY($%d)", filter.Ids)
+	}
+	if filter.Name != "" {
+		where("name = $%d", filter.Name)
+	}
+	if !filter.From.IsZero() {
+		where("dead_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		where("dead_at <= $%d", filter.To)
+	}
+	query := `SELECT id, name, payload, created_at, dead_at, attempts, last_error, history, emitter FROM ` + r.tableName
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var deadLetters []*DeadLetter
+	for rows.Next() {
+		var deadLetter DeadLetter
+		var history []byte
+		err := rows.Scan(
+			&deadLetter.Id, &deadLetter.Name, &deadLetter.Payload, &deadLetter.CreatedAt, &deadLetter.DeadAt,
+			&deadLetter.Attempts, &deadLetter.LastError, &history, &deadLetter.Emitter,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if len(history) > 0 {
+			if err := json.Unmarshal(history, &deadLetter.History); err != nil {
+				return nil, fmt.Errorf("invalid history of dead letter %s: %w", deadLetter.Id, err)
+			}
+		}
+		deadLetters = append(deadLetters, &deadLetter)
+	}
+	return deadLetters, rows.Err()
+}
+
+func (r *PostgresDeadLetterRepository) Delete(ctx context.Context, id string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM `+r.tableName+` WHERE id = $1`, id)
+	return err
+}
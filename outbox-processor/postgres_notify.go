@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5"
+	"log/slog"
+	"time"
+)
+
+const (
+	DefaultPostgresFallbackPollInterval = 30 * time.Second
+	PostgresNotifyChannel               = "outbox_events"
+
+	postgresMinListenBackoff   = time.Second
+	postgresMaxListenBackoff   = 30 * time.Second
+	postgresListenCloseTimeout = 5 * time.Second
+)
+
+// PostgresNotifier LISTENs on a connection of its own for the notifications the
+// trigger created by migrations/postgres sends when a record is written or
+// rescheduled, reconnecting with backoff when the connection is lost.
+type PostgresNotifier struct {
+	server  string
+	channel string
+}
+
+func NewPostgresNotifier(server, channel string) *PostgresNotifier {
+	return &PostgresNotifier{server: server, channel: channel}
+}
+
+func (n *PostgresNotifier) Listen(ctx context.Context, wake chan<- struct{}) {
+	backoff := postgresMinListenBackoff
+	for {
+		listened, err := n.waitForNotifications(ctx, wake)
+		if ctx.Err() != nil {
+			return
+		}
+		if listened {
+			backoff = postgresMinListenBackoff
+		}
+		slog.Error("Error listening for outbox notifications, retrying", "channel", n.channel, "backoff", backoff, "error", err)
+		if !sleep(ctx, backoff) {
+			return
+		}
+		backoff = min(backoff*2, postgresMaxListenBackoff)
+	}
+}
+
+// waitForNotifications listens on a new connection and wakes the poller up on every
+// notification until the connection fails, reporting whether LISTEN succeeded.
+func (n *PostgresNotifier) waitForNotifications(ctx context.Context, wake chan<- struct{}) (bool, error) {
+	conn, err := pgx.Connect(ctx, n.server)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), postgresListenCloseTimeout)
+		defer cancel()
+		conn.Close(closeCtx)
+	}()
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{n.channel}.Sanitize()); err != nil {
+		return false, err
+	}
+	// Records written while nobody was listening were not notified.
+	notify(wake)
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return true, err
+		}
+		notify(wake)
+	}
+}
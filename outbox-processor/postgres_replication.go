@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+	"log/slog"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPostgresSlotName    = "outbox_processor"
+	DefaultPostgresPublication = "outbox_events"
+
+	postgresStandbyStatusInterval = 10 * time.Second
+	// postgresReplicationQueueSize is how many decoded transactions may wait for
+	// delivery before the stream stops reading the WAL.
+	postgresReplicationQueueSize = 16
+)
+
+// replicationSlotName matches the names Postgres accepts for replication slots,
+// which replication commands take unquoted.
+var replicationSlotName = regexp.MustCompile(`^[a-z0-9_]{1,63}$`)
+
+// PostgresReplicationStream tails the WAL of the outbox table through a pgoutput
+// logical replication slot, creating the slot and a publication for the table
+// when they do not exist yet. Rows are delivered once their transaction commits,
+// and the slot is only confirmed past a transaction after every record it
+// delivered has been acknowledged as handled, so records in flight when the
+// processor stops are replayed when it starts again.
+//
+// A slot serves one connection at a time: other replicas using the same slot keep
+// retrying to start replication and take over when the active one goes away.
+// A slot nobody reads from makes Postgres retain WAL, so dropOnExit drops the slot
+// and the publication when the stream stops, e.g. for short-lived environments.
+type PostgresReplicationStream struct {
+	outboxRepository *PostgresOutboxRepository
+	server           string
+	tableName        string
+	slotName         string
+	publication      string
+	dropOnExit       bool
+	typeMap          *pgtype.Map
+	tracker          *lsnTracker
+	errors           chan error
+}
+
+func NewPostgresReplicationStream(outboxRepository *PostgresOutboxRepository, server, tableName, slotName, publication string, dropOnExit bool) *PostgresReplicationStream {
+	return &PostgresReplicationStream{
+		outboxRepository: outboxRepository,
+		server:           server,
+		tableName:        tableName,
+		slotName:         slotName,
+		publication:      publication,
+		dropOnExit:       dropOnExit,
+		typeMap:          pgtype.NewMap(),
+		tracker:          newLsnTracker(),
+		errors:           make(chan error, 1),
+	}
+}
+
+func (stream *PostgresReplicationStream) FetchEvents(ctx context.Context) (chan *Outbox, error) {
+	if err := stream.setup(ctx); err != nil {
+		return nil, err
+	}
+	events := newEventChannel(ctx)
+	// Records the delay queue drops are left to the sweeper, so they must not hold
+	// the slot back.
+	events.onDropped(stream.tracker.ack)
+	transactions := make(chan []*Outbox, postgresReplicationQueueSize)
+	events.goTracked(func() { stream.deliver(transactions, events) })
+	go func() {
+		defer close(transactions)
+		stream.replicate(ctx, transactions)
+	}()
+	events.closeWhenDone()
+	return events.events, nil
+}
+
+func (stream *PostgresReplicationStream) Errors() <-chan error {
+	return stream.errors
+}
+
+// Ack marks a delivered record as handled, letting the slot move past its
+// transaction once the transactions before it are done too.
+func (stream *PostgresReplicationStream) Ack(outbox *Outbox) {
+	stream.tracker.ack(outbox)
+}
+
+func (stream *PostgresReplicationStream) fail(err error) {
+	select {
+	case stream.errors <- err:
+	default:
+	}
+}
+
+// setup creates the publication and the replication slot unless they already exist.
+func (stream *PostgresReplicationStream) setup(ctx context.Context) error {
+	if !replicationSlotName.MatchString(stream.slotName) {
+		return fmt.Errorf("invalid replication slot name %q", stream.slotName)
+	}
+	conn, err := stream.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer closePostgresConn(conn)
+	// CREATE PUBLICATION has no IF NOT EXISTS, an existing one fails as a duplicate.
+	_, err = conn.Exec(ctx, fmt.Sprintf(
+		"CREATE PUBLICATION %s FOR TABLE %s WITH (publish = 'insert, update')",
+		pgx.Identifier{stream.publication}.Sanitize(), pgx.Identifier{stream.tableName}.Sanitize(),
+	)).ReadAll()
+	if err != nil && !isPostgresDuplicate(err) {
+		return fmt.Errorf("creating publication %s: %w", stream.publication, err)
+	}
+	_, err = pglogrepl.CreateReplicationSlot(ctx, conn, stream.slotName, "pgoutput", pglogrepl.CreateReplicationSlotOptions{Mode: pglogrepl.LogicalReplication})
+	if err != nil && !isPostgresDuplicate(err) {
+		return fmt.Errorf("creating replication slot %s: %w", stream.slotName, err)
+	}
+	return nil
+}
+
+// teardown drops the replication slot and the publication, waiting for the slot to
+// be released by the connection that just stopped using it.
+func (stream *PostgresReplicationStream) teardown(ctx context.Context) error {
+	conn, err := stream.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer closePostgresConn(conn)
+	if err := pglogrepl.DropReplicationSlot(ctx, conn, stream.slotName, pglogrepl.DropReplicationSlotOptions{Wait: true}); err != nil {
+		return fmt.Errorf("dropping replication slot %s: %w", stream.slotName, err)
+	}
+	_, err = conn.Exec(ctx, "DROP PUBLICATION IF EXISTS "+pgx.Identifier{stream.publication}.Sanitize()).ReadAll()
+	return err
+}
+
+func (stream *PostgresReplicationStream) connect(ctx context.Context) (*pgconn.PgConn, error) {
+	config, err := pgconn.ParseConfig(stream.server)
+	if err != nil {
+		return nil, err
+	}
+	config.RuntimeParams["replication"] = "database"
+	return pgconn.ConnectConfig(ctx, config)
+}
+
+// replicate streams changes until ctx is done, reconnecting with backoff when the
+// connection fails, or reporting the failure when retrying cannot help.
+func (stream *PostgresReplicationStream) replicate(ctx context.Context, transactions chan<- []*Outbox) {
+	backoff := postgresMinListenBackoff
+	for {
+		started, err := stream.stream(ctx, transactions)
+		if ctx.Err() != nil {
+			break
+		}
+		if isPostgresFatal(err) {
+			slog.Error("Error replicating the outbox table", "slot", stream.slotName, "error", err)
+			stream.fail(err)
+			break
+		}
+		if started {
+			backoff = postgresMinListenBackoff
+		}
+		slog.Error("Error replicating the outbox table, retrying", "slot", stream.slotName, "backoff", backoff, "error", err)
+		if !sleep(ctx, backoff) {
+			break
+		}
+		backoff = min(backoff*2, postgresMaxListenBackoff)
+	}
+	if stream.dropOnExit {
+		dropCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		if err := stream.teardown(dropCtx); err != nil {
+			slog.Error("Error dropping the replication slot", "slot", stream.slotName, "error", err)
+		}
+	}
+}
+
+// stream replicates on a new connection until it fails, reporting whether
+// replication started. Rows are decoded as they arrive and handed over in
+// transactions, while standby status updates keep confirming what was handled.
+func (stream *PostgresReplicationStream) stream(ctx context.Context, transactions chan<- []*Outbox) (bool, error) {
+	conn, err := stream.connect(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer closePostgresConn(conn)
+	err = pglogrepl.StartReplication(ctx, conn, stream.slotName, 0, pglogrepl.StartReplicationOptions{
+		Mode: pglogrepl.LogicalReplication,
+		PluginArgs: []string{
+			"proto_version '1'",
+			fmt.Sprintf("publication_names '%s'", stream.publication),
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	slog.Info("Replicating the outbox table", "slot", stream.slotName)
+	// Replication restarts from the slot's confirmed position, so records delivered
+	// on the previous connection and not acknowledged yet are delivered again.
+	stream.tracker.reset()
+
+	relations := make(map[uint32]*pglogrepl.RelationMessage)
+	var transaction []*Outbox
+	inTransaction := false
+	nextStatus := time.Now().Add(postgresStandbyStatusInterval)
+	sendStatus := func() error {
+		nextStatus = time.Now().Add(postgresStandbyStatusInterval)
+		return pglogrepl.SendStandbyStatusUpdate(ctx, conn, pglogrepl.StandbyStatusUpdate{WALWritePosition: stream.tracker.confirmed()})
+	}
+	for {
+		if !time.Now().Before(nextStatus) {
+			if err := sendStatus(); err != nil {
+				return true, err
+			}
+		}
+		receiveCtx, cancel := context.WithDeadline(ctx, nextStatus)
+		message, err := conn.ReceiveMessage(receiveCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return true, ctx.Err()
+		}
+		if pgconn.Timeout(err) {
+			continue
+		}
+		if err != nil {
+			return true, err
+		}
+		var data []byte
+		switch message := message.(type) {
+		case *pgproto3.ErrorResponse:
+			return true, pgconn.ErrorResponseToPgError(message)
+		case *pgproto3.CopyData:
+			data = message.Data
+		default:
+			continue
+		}
+
+		switch data[0] {
+		case pglogrepl.PrimaryKeepaliveMessageByteID:
+			keepalive, err := pglogrepl.ParsePrimaryKeepaliveMessage(data[1:])
+			if err != nil {
+				return true, err
+			}
+			// Everything up to the server's position has been sent, so with nothing in
+			// flight the slot can move past changes to other tables too.
+			if !inTransaction {
+				stream.tracker.idle(keepalive.ServerWALEnd)
+			}
+			if keepalive.ReplyRequested {
+				nextStatus = time.Time{}
+			}
+		case pglogrepl.XLogDataByteID:
+			xLogData, err := pglogrepl.ParseXLogData(data[1:])
+			if err != nil {
+				return true, err
+			}
+			logical, err := pglogrepl.Parse(xLogData.WALData)
+			if err != nil {
+				return true, err
+			}
+			switch logical := logical.(type) {
+			case *pglogrepl.RelationMessage:
+				relations[logical.RelationID] = logical
+			case *pglogrepl.BeginMessage:
+				inTransaction, transaction = true, nil
+			case *pglogrepl.InsertMessage:
+				transaction = stream.appendRow(ctx, transaction, relations[logical.RelationID], logical.Tuple)
+			case *pglogrepl.UpdateMessage:
+				transaction = stream.appendRow(ctx, transaction, relations[logical.RelationID], logical.NewTuple)
+			case *pglogrepl.CommitMessage:
+				inTransaction = false
+				stream.tracker.track(logical.TransactionEndLSN, transaction)
+				if len(transaction) == 0 {
+					continue
+				}
+				// While delivery is behind, status updates keep the connection alive.
+				for handedOver := false; !handedOver; {
+					select {
+					case transactions <- transaction:
+						handedOver = true
+					case <-ctx.Done():
+						return true, ctx.Err()
+					case <-time.After(time.Until(nextStatus)):
+						if err := sendStatus(); err != nil {
+							return true, err
+						}
+					}
+				}
+				transaction = nil
+			}
+		}
+	}
+}
+
+// appendRow decodes a row of the outbox table and adds it to the transaction when it
+// awaits handling. Claimed and finished rows are skipped so they are never tracked
+// without being acked, and an expired lease is left to the sweeper. Rows that cannot
+// be decoded are logged and skipped; the sweeper picks them up from the table if
+// they still need handling.
+func (stream *PostgresReplicationStream) appendRow(ctx context.Context, transaction []*Outbox, relation *pglogrepl.RelationMessage, tuple *pglogrepl.TupleData) []*Outbox {
+	if relation == nil || relation.RelationName != stream.tableName || tuple == nil {
+		return transaction
+	}
+	outbox, err := stream.decodeRow(ctx, relation, tuple)
+	if err != nil {
+		slog.Error("Error decoding replicated outbox row", "slot", stream.slotName, "error", err)
+		return transaction
+	}
+	if outbox == nil || !awaitsHandling(outbox) {
+		return transaction
+	}
+	return append(transaction, outbox)
+}
+
+// decodeRow decodes the text values of a row. Large values left unchanged by an
+// update are not sent again, in which case the record is read from the table; it
+// is nil when the record no longer exists.
+func (stream *PostgresReplicationStream) decodeRow(ctx context.Context, relation *pglogrepl.RelationMessage, tuple *pglogrepl.TupleData) (*Outbox, error) {
+	var outbox Outbox
+	var headers, history []byte
+	columns := map[string]any{
+		"id":                &outbox.Id,
+		"name":              &outbox.Name,
+		"ordering_key":      &outbox.OrderingKey,
+		"payload":           &outbox.Payload,
+		"headers":           &headers,
+		"status":            &outbox.Status,
+		"created_at":        &outbox.CreatedAt,
+		"processed_at":      &outbox.ProcessedAt,
+		"last_attempt_time": &outbox.LastAttemptTime,
+		"attempts":          &outbox.Attempts,
+		"next_attempt_at":   &outbox.NextAttemptAt,
+		"last_error":        &outbox.LastError,
+		"history":           &history,
+		"owner":             &outbox.Owner,
+		"lease_expires_at":  &outbox.LeaseExpiresAt,
+		"version":           &outbox.Version,
+	}
+	unchanged := false
+	for i, column := range tuple.Columns {
+		if i >= len(relation.Columns) {
+			break
+		}
+		destination, ok := columns[relation.Columns[i].Name]
+		if !ok {
+			continue
+		}
+		switch column.DataType {
+		case pglogrepl.TupleDataTypeText:
+			if err := stream.typeMap.Scan(relation.Columns[i].DataType, pgtype.TextFormatCode, column.Data, destination); err != nil {
+				return nil, fmt.Errorf("decoding column %s: %w", relation.Columns[i].Name, err)
+			}
+		case pglogrepl.TupleDataTypeToast:
+			unchanged = true
+		}
+	}
+	if unchanged {
+		return stream.outboxRepository.Get(ctx, outbox.Id)
+	}
+	if len(headers) > 0 {
+		if err := json.Unmarshal(headers, &outbox.Headers); err != nil {
+			return nil, fmt.Errorf("invalid headers of outbox record %s: %w", outbox.Id, err)
+		}
+	}
+	if len(history) > 0 {
+		if err := json.Unmarshal(history, &outbox.History); err != nil {
+			return nil, fmt.Errorf("invalid history of outbox record %s: %w", outbox.Id, err)
+		}
+	}
+	return &outbox, nil
+}
+
+// deliver dispatches the records of each transaction in commit order.
+func (stream *PostgresReplicationStream) deliver(transactions <-chan []*Outbox, events *eventChannel) {
+	for transaction := range transactions {
+		for _, outbox := range transaction {
+			if !events.dispatch(outbox) {
+				return
+			}
+		}
+	}
+}
+
+func closePostgresConn(conn *pgconn.PgConn) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresListenCloseTimeout)
+	defer cancel()
+	conn.Close(ctx)
+}
+
+func isPostgresDuplicate(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "42710"
+}
+
+// isPostgresFatal reports errors reconnecting does not fix: missing privileges, a
+// server without wal_level=logical, a slot dropped by someone else or bad credentials.
+func isPostgresFatal(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	switch pgErr.Code {
+	case "42501", "55000", "42704", "28000", "28P01":
+		return true
+	}
+	return false
+}
+
+// lsnTracker follows the transactions whose records are in flight, in commit order,
+// and computes the position the replication slot can be confirmed at: the end of
+// the last transaction that, like every one before it, has no record left in flight.
+type lsnTracker struct {
+	mutex        sync.Mutex
+	transactions []*trackedTransaction
+	records      map[*Outbox]*trackedTransaction
+	latest       map[string]*Outbox
+	position     pglogrepl.LSN
+}
+
+type trackedTransaction struct {
+	endLSN   pglogrepl.LSN
+	inFlight int
+}
+
+func newLsnTracker() *lsnTracker {
+	return &lsnTracker{records: make(map[*Outbox]*trackedTransaction), latest: make(map[string]*Outbox)}
+}
+
+// track registers the records a committed transaction is about to deliver. A record
+// replaces any earlier version of it still in flight, which may never be
+// acknowledged, e.g. when the delay queue drops it; the newer version keeps the
+// slot from moving past it anyway.
+func (t *lsnTracker) track(endLSN pglogrepl.LSN, records []*Outbox) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	transaction := &trackedTransaction{endLSN: endLSN, inFlight: len(records)}
+	t.transactions = append(t.transactions, transaction)
+	for _, outbox := range records {
+		if previous, ok := t.latest[outbox.Id]; ok {
+			t.done(previous)
+		}
+		t.records[outbox] = transaction
+		t.latest[outbox.Id] = outbox
+	}
+	t.advance()
+}
+
+func (t *lsnTracker) ack(outbox *Outbox) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.done(outbox)
+	t.advance()
+}
+
+// idle moves the position to the given one when no transaction is in flight.
+func (t *lsnTracker) idle(position pglogrepl.LSN) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.transactions) == 0 {
+		t.position = max(t.position, position)
+	}
+}
+
+// reset forgets the records in flight, which are delivered again after a reconnection.
+func (t *lsnTracker) reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.transactions = nil
+	clear(t.records)
+	clear(t.latest)
+}
+
+func (t *lsnTracker) confirmed() pglogrepl.LSN {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.position
+}
+
+func (t *lsnTracker) done(outbox *Outbox) {
+	transaction, ok := t.records[outbox]
+	if !ok {
+		return
+	}
+	delete(t.records, outbox)
+	if t.latest[outbox.Id] == outbox {
+		delete(t.latest, outbox.Id)
+	}
+	transaction.inFlight--
+}
+
+func (t *lsnTracker) advance() {
+	for len(t.transactions) > 0 && t.transactions[0].inFlight == 0 {
+		// Transactions replayed after a reconnection may end before the position.
+		t.position = max(t.position, t.transactions[0].endLSN)
+		t.transactions = t.transactions[1:]
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+	"testing"
+	"time"
+)
+
+func TestPostgresReplicationAppendsRowsAwaitingHandling(t *testing.T) {
+	stream := NewPostgresReplicationStream(nil, "", "outbox_events", "outbox", "outbox", false)
+	relation := &pglogrepl.RelationMessage{
+		RelationName: "outbox_events",
+		Columns: []*pglogrepl.RelationMessageColumn{
+			{Name: "id", DataType: pgtype.TextOID},
+			{Name: "status", DataType: pgtype.TextOID},
+			{Name: "lease_expires_at", DataType: pgtype.TimestamptzOID},
+			{Name: "version", DataType: pgtype.Int8OID},
+		},
+	}
+	expired := time.Now().Add(-time.Minute).UTC().Format("2006-01-02 15:04:05.999999-07")
+	live := time.Now().Add(time.Minute).UTC().Format("2006-01-02 15:04:05.999999-07")
+	for _, test := range []struct {
+		name     string
+		status   string
+		lease    string
+		relation string
+		appended bool
+	}{
+		{name: "pending", status: OutboxStatusPending, appended: true},
+		{name: "failed", status: OutboxStatusError, appended: true},
+		{name: "claimed", status: OutboxStatusInProgress, lease: live},
+		{name: "claim expired", status: OutboxStatusInProgress, lease: expired, appended: true},
+		{name: "processed", status: OutboxStatusProcessed},
+		{name: "dead", status: OutboxStatusDead},
+		{name: "other table", status: OutboxStatusPending, relation: "payments"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			lease := &pglogrepl.TupleDataColumn{DataType: pglogrepl.TupleDataTypeNull}
+			if test.lease != "" {
+				lease = &pglogrepl.TupleDataColumn{DataType: pglogrepl.TupleDataTypeText, Data: []byte(test.lease)}
+			}
+			tuple := &pglogrepl.TupleData{Columns: []*pglogrepl.TupleDataColumn{
+				{DataType: pglogrepl.TupleDataTypeText, Data: []byte("1")},
+				{DataType: pglogrepl.TupleDataTypeText, Data: []byte(test.status)},
+				lease,
+				{DataType: pglogrepl.TupleDataTypeText, Data: []byte("3")},
+			}}
+			rowRelation := relation
+			if test.relation != "" {
+				rowRelation = &pglogrepl.RelationMessage{RelationName: test.relation, Columns: relation.Columns}
+			}
+
+			transaction := stream.appendRow(context.Background(), nil, rowRelation, tuple)
+
+			if appended := len(transaction) == 1; appended != test.appended {
+				t.Fatalf("appended = %v, want %v", appended, test.appended)
+			}
+			if test.appended && (transaction[0].Id != "1" || transaction[0].Status != test.status || transaction[0].Version != 3) {
+				t.Errorf("decoded %+v", transaction[0])
+			}
+		})
+	}
+}
+
+func TestLsnTrackerConfirmsTransactionsOnceHandled(t *testing.T) {
+	tracker := newLsnTracker()
+	first, second, third := &Outbox{Id: "1"}, &Outbox{Id: "2"}, &Outbox{Id: "3"}
+	tracker.track(10, []*Outbox{first})
+	// A transaction whose rows were all skipped has nothing in flight.
+	tracker.track(20, nil)
+	tracker.track(30, []*Outbox{second, third})
+
+	if got := tracker.confirmed(); got != 0 {
+		t.Fatalf("confirmed %s with record 1 in flight", got)
+	}
+	tracker.ack(second)
+	tracker.ack(first)
+	if got := tracker.confirmed(); got != 20 {
+		t.Errorf("confirmed %s, want 0/14 with record 3 in flight", got)
+	}
+	tracker.ack(third)
+	if got := tracker.confirmed(); got != 30 {
+		t.Errorf("confirmed %s, want 0/1E", got)
+	}
+}
+
+func TestLsnTrackerReleasesSupersededAndDroppedRecords(t *testing.T) {
+	tracker := newLsnTracker()
+	events := newEventChannel(context.Background())
+	events.onDropped(tracker.ack)
+	later := time.Now().Add(time.Hour)
+	failed := &Outbox{Id: "1", Status: OutboxStatusError, NextAttemptAt: &later}
+	retried := &Outbox{Id: "1", Status: OutboxStatusError, NextAttemptAt: &later}
+
+	tracker.track(10, []*Outbox{failed})
+	events.dispatch(failed)
+	tracker.track(20, []*Outbox{retried})
+	events.dispatch(retried)
+	if got := tracker.confirmed(); got != 10 {
+		t.Errorf("confirmed %s, want 0/A once the first copy is superseded", got)
+	}
+	// The record is claimed elsewhere, so the parked copy is dropped and never acked.
+	events.delayed.drop("1")
+	if got := tracker.confirmed(); got != 20 {
+		t.Errorf("confirmed %s, want 0/14 once the parked copy is dropped", got)
+	}
+}
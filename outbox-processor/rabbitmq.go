@@ -1,47 +1,270 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"log/slog"
+	"sync"
+	"time"
 )
 
+const DefaultRabbitMqConfirmTimeout = 5 * time.Second
+
+// RabbitMqEventEmitter publishes persistent, mandatory messages on a channel in
+// confirm mode. An event only counts as emitted once the broker acked it and did
+// not return it as unroutable, so no record is marked processed for a message
+// the broker dropped. While the broker is unreachable, emitting fails right away
+// so the record goes to retry, and the connection is re-established in the background.
 type RabbitMqEventEmitter struct {
-	connection      *amqp.Connection
-	producerChannel *amqp.Channel
+	connection     *rabbitMqConnection
+	topology       RabbitMqTopology
+	confirmTimeout time.Duration
+
+	mutex    sync.Mutex
+	receipts map[*amqp.Channel]*rabbitMqReceipts
 }
 
-func NewRabbitMqEventEmitter(server string) EventEmitter {
-	connection, err := amqp.Dial(server)
-	if err != nil {
-		panic(err)
+func NewRabbitMqEventEmitter(server string, tlsConfig *tls.Config, topology RabbitMqTopology, confirmTimeout time.Duration) *RabbitMqEventEmitter {
+	emitter := &RabbitMqEventEmitter{
+		topology:       topology,
+		confirmTimeout: confirmTimeout,
+		receipts:       make(map[*amqp.Channel]*rabbitMqReceipts),
 	}
-	producerChannel, err := connection.Channel()
+	emitter.connection = newRabbitMqConnection(server, tlsConfig, func(channel *amqp.Channel) error {
+		if err := topology.Declare(channel); err != nil {
+			return err
+		}
+		receipts := newRabbitMqReceipts()
+		emitter.mutex.Lock()
+		emitter.receipts[channel] = receipts
+		emitter.mutex.Unlock()
+		go func() {
+			receipts.collect(channel.NotifyReturn(make(chan amqp.Return)), channel.NotifyPublish(make(chan amqp.Confirmation)))
+			emitter.mutex.Lock()
+			delete(emitter.receipts, channel)
+			emitter.mutex.Unlock()
+		}()
+		return nil
+	})
+	return emitter
+}
+
+func (e *RabbitMqEventEmitter) Name() string {
+	return "rabbitmq"
+}
+
+func (e *RabbitMqEventEmitter) Emit(ctx context.Context, event *Event) error {
+	receipt, err := e.publish(ctx, event)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	return e.await(ctx, event, receipt)
+}
+
+// EmitBatch publishes every event before waiting for any confirmation, so a batch
+// costs one round trip to the broker instead of one per event.
+func (e *RabbitMqEventEmitter) EmitBatch(ctx context.Context, events []*Event) []error {
+	errs := make([]error, len(events))
+	receipts := make([]rabbitMqReceipt, len(events))
+	for i, event := range events {
+		receipts[i], errs[i] = e.publish(ctx, event)
 	}
-	return &RabbitMqEventEmitter{
-		connection:      connection,
-		producerChannel: producerChannel,
+	for i, receipt := range receipts {
+		if errs[i] == nil {
+			errs[i] = e.await(ctx, events[i], receipt)
+		}
 	}
+	return errs
 }
 
-func (e *RabbitMqEventEmitter) Emit(event *Event) error {
+func (e *RabbitMqEventEmitter) publish(ctx context.Context, event *Event) (rabbitMqReceipt, error) {
 	eventBytes, err := json.Marshal(event)
 	if err != nil {
 		slog.Error("Error on emit event", "event", event, "error", err)
-		return err
+		return rabbitMqReceipt{}, err
 	}
-	err = e.producerChannel.Publish(
-		"amq.direct",
-		event.Name,
-		false,
+	channel, err := e.connection.Channel()
+	if err != nil {
+		return rabbitMqReceipt{}, err
+	}
+	e.mutex.Lock()
+	receipts, ok := e.receipts[channel]
+	e.mutex.Unlock()
+	if !ok {
+		return rabbitMqReceipt{}, errors.New("rabbitmq channel is closing")
+	}
+	exchange, routingKey := e.topology.Route(event)
+	confirmation, err := channel.PublishWithDeferredConfirmWithContext(
+		ctx,
+		exchange,
+		routingKey,
+		true,
 		false,
-		amqp.Publishing{ContentType: "text/plain", Body: eventBytes},
+		amqp.Publishing{
+			// Headers let headers exchanges route on the event without decoding the body.
+			Headers:      amqp.Table{"event_name": event.Name, "event_id": event.ID},
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    event.ID,
+			Timestamp:    time.Now(),
+			Type:         event.Name,
+			Body:         eventBytes,
+		},
 	)
 	if err != nil {
 		slog.Error("Error on publish event", "event", event, "error", err)
-		return err
+		return rabbitMqReceipt{}, err
+	}
+	return rabbitMqReceipt{confirmation: confirmation, receipts: receipts}, nil
+}
+
+// await waits for the broker to confirm a publish, up to the confirm timeout.
+func (e *RabbitMqEventEmitter) await(ctx context.Context, event *Event, receipt rabbitMqReceipt) error {
+	ctx, cancel := context.WithTimeout(ctx, e.confirmTimeout)
+	defer cancel()
+	tag := receipt.confirmation.DeliveryTag
+	acked, err := receipt.confirmation.WaitContext(ctx)
+	if err == nil {
+		// The broker returns an unroutable message before acking it, so once the
+		// collector passed the ack any return of the event has been recorded.
+		err = receipt.receipts.wait(ctx, tag)
+	}
+	if err != nil {
+		receipt.receipts.abandon(tag, event.ID)
+		return fmt.Errorf("waiting for publish confirmation: %w", err)
+	}
+	returned, wasReturned := receipt.receipts.take(event.ID)
+	switch {
+	case !acked:
+		return errors.New("event was nacked by the broker")
+	case wasReturned:
+		return fmt.Errorf("event was returned by the broker: %d %s", returned.ReplyCode, returned.ReplyText)
 	}
 	return nil
 }
+
+// rabbitMqReceipt ties a publish to the receipts of the channel it went out on.
+type rabbitMqReceipt struct {
+	confirmation *amqp.DeferredConfirmation
+	receipts     *rabbitMqReceipts
+}
+
+// rabbitMqReceipts records the returns and confirmations of one channel. Both
+// are read by a single goroutine: the client hands over a basic.return before it
+// processes the basic.ack that follows it, so a return is always recorded before
+// the confirmation of its message is.
+type rabbitMqReceipts struct {
+	mutex     sync.Mutex
+	returned  map[string]amqp.Return
+	abandoned map[uint64]string
+	confirmed uint64
+	closed    bool
+	// advanced is closed and replaced whenever confirmed or closed changes.
+	advanced chan struct{}
+}
+
+func newRabbitMqReceipts() *rabbitMqReceipts {
+	return &rabbitMqReceipts{
+		returned:  make(map[string]amqp.Return),
+		abandoned: make(map[uint64]string),
+		advanced:  make(chan struct{}),
+	}
+}
+
+// collect records returns and confirmations until the channel closes both.
+func (r *rabbitMqReceipts) collect(returns <-chan amqp.Return, confirmations <-chan amqp.Confirmation) {
+	defer r.close()
+	for returns != nil || confirmations != nil {
+		select {
+		case returned, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			r.mutex.Lock()
+			r.returned[returned.MessageId] = returned
+			r.mutex.Unlock()
+			slog.Warn("Event was returned by the broker", "id", returned.MessageId, "exchange", returned.Exchange, "routing_key", returned.RoutingKey, "reason", returned.ReplyText)
+		case confirmation, ok := <-confirmations:
+			if !ok {
+				confirmations = nil
+				continue
+			}
+			r.confirm(confirmation.DeliveryTag)
+		}
+	}
+}
+
+func (r *rabbitMqReceipts) confirm(tag uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.confirmed = max(r.confirmed, tag)
+	// Nobody waits for an abandoned publish any more, so drop its return.
+	if id, ok := r.abandoned[tag]; ok {
+		delete(r.returned, id)
+		delete(r.abandoned, tag)
+	}
+	r.advance()
+}
+
+func (r *rabbitMqReceipts) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.closed = true
+	r.advance()
+}
+
+func (r *rabbitMqReceipts) advance() {
+	close(r.advanced)
+	r.advanced = make(chan struct{})
+}
+
+// wait blocks until the collector passed the confirmation of tag.
+func (r *rabbitMqReceipts) wait(ctx context.Context, tag uint64) error {
+	for {
+		r.mutex.Lock()
+		if r.closed || r.confirmed >= tag {
+			r.mutex.Unlock()
+			return nil
+		}
+		advanced := r.advanced
+		r.mutex.Unlock()
+		select {
+		case <-advanced:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (r *rabbitMqReceipts) take(id string) (amqp.Return, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	returned, ok := r.returned[id]
+	delete(r.returned, id)
+	return returned, ok
+}
+
+// abandon drops the return of a publish nobody waits for any more, including
+// one that only arrives after the wait gave up.
+func (r *rabbitMqReceipts) abandon(tag uint64, id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.returned, id)
+	if !r.closed && r.confirmed < tag {
+		r.abandoned[tag] = id
+	}
+}
+
+// Healthy reports an error while the emitter is disconnected from the broker.
+func (e *RabbitMqEventEmitter) Healthy() error {
+	return e.connection.Healthy()
+}
+
+func (e *RabbitMqEventEmitter) Close() error {
+	return e.connection.Close()
+}
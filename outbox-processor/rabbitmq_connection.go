@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	rabbitMqMinReconnectBackoff = time.Second
+	rabbitMqMaxReconnectBackoff = 30 * time.Second
+)
+
+var ErrRabbitMqDisconnected = errors.New("not connected to RabbitMQ")
+
+// rabbitMqConnection keeps a connection and a confirm-mode channel to the broker
+// open. Whenever either of them closes it reconnects with backoff and runs setup
+// on the new channel, e.g. to declare topology and register listeners. While it
+// is disconnected Channel fails right away instead of handing out a dead channel.
+type rabbitMqConnection struct {
+	server    string
+	tlsConfig *tls.Config
+	setup     func(channel *amqp.Channel) error
+
+	mutex      sync.RWMutex
+	connection *amqp.Connection
+	channel    *amqp.Channel
+	closing    chan struct{}
+	closeOnce  sync.Once
+}
+
+// newRabbitMqConnection connects to server, over TLS with tlsConfig when it is set. An
+// amqps:// server without tlsConfig is reached over TLS with the system roots.
+func newRabbitMqConnection(server string, tlsConfig *tls.Config, setup func(channel *amqp.Channel) error) *rabbitMqConnection {
+	c := &rabbitMqConnection{server: server, tlsConfig: tlsConfig, setup: setup, closing: make(chan struct{})}
+	go c.maintain()
+	return c
+}
+
+// Channel returns the current channel, or ErrRabbitMqDisconnected while reconnecting.
+func (c *rabbitMqConnection) Channel() (*amqp.Channel, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.channel == nil || c.channel.IsClosed() {
+		return nil, ErrRabbitMqDisconnected
+	}
+	return c.channel, nil
+}
+
+// Healthy reports ErrRabbitMqDisconnected while there is no open channel.
+func (c *rabbitMqConnection) Healthy() error {
+	_, err := c.Channel()
+	return err
+}
+
+func (c *rabbitMqConnection) Close() error {
+	c.closeOnce.Do(func() { close(c.closing) })
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var errs []error
+	if c.channel != nil {
+		errs = append(errs, c.channel.Close())
+	}
+	if c.connection != nil {
+		errs = append(errs, c.connection.Close())
+	}
+	c.channel, c.connection = nil, nil
+	return errors.Join(errs...)
+}
+
+func (c *rabbitMqConnection) maintain() {
+	backoff := rabbitMqMinReconnectBackoff
+	for {
+		connection, channel, err := c.connect()
+		if err != nil {
+			slog.Error("Error connecting to RabbitMQ, retrying", "backoff", backoff, "error", err)
+			select {
+			case <-c.closing:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, rabbitMqMaxReconnectBackoff)
+			continue
+		}
+		backoff = rabbitMqMinReconnectBackoff
+		connectionClosed := connection.NotifyClose(make(chan *amqp.Error, 1))
+		channelClosed := channel.NotifyClose(make(chan *amqp.Error, 1))
+		c.mutex.Lock()
+		select {
+		case <-c.closing:
+			c.mutex.Unlock()
+			connection.Close()
+			return
+		default:
+		}
+		c.connection, c.channel = connection, channel
+		c.mutex.Unlock()
+		slog.Info("Connected to RabbitMQ")
+
+		var reason *amqp.Error
+		select {
+		case <-c.closing:
+			return
+		case reason = <-connectionClosed:
+		case reason = <-channelClosed:
+		}
+		slog.Warn("RabbitMQ connection lost, reconnecting", "reason", reason)
+		c.mutex.Lock()
+		c.connection, c.channel = nil, nil
+		c.mutex.Unlock()
+		// The connection may still be open when only the channel was closed by the broker.
+		connection.Close()
+	}
+}
+
+func (c *rabbitMqConnection) connect() (*amqp.Connection, *amqp.Channel, error) {
+	connection, err := amqp.DialTLS(c.server, c.tlsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	channel, err := connection.Channel()
+	if err == nil {
+		err = channel.Confirm(false)
+	}
+	if err == nil && c.setup != nil {
+		err = c.setup(channel)
+	}
+	if err != nil {
+		connection.Close()
+		return nil, nil, err
+	}
+	return connection, channel, nil
+}
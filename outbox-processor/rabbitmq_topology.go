@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"os"
+	"regexp"
+)
+
+type (
+	// RabbitMqTopology describes the exchanges, queues and bindings declared when the
+	// emitter connects, and how events are routed to exchanges. It is usually loaded
+	// from a JSON file, e.g.
+	//
+	//	{
+	//	  "exchanges": [{"name": "payments", "kind": "topic", "durable": true}],
+	//	  "queues": [{"name": "payments.processed", "durable": true}],
+	//	  "bindings": [{"queue": "payments.processed", "exchange": "payments", "routing_key": "payments.PAYMENT_PROCESSED"}],
+	//	  "routes": {"PAYMENT_PROCESSED": {"exchange": "payments", "routing_key": "payments.{name}"}}
+	//	}
+	RabbitMqTopology struct {
+		Exchanges    []RabbitMqExchange       `json:"exchanges"`
+		Queues       []RabbitMqQueue          `json:"queues"`
+		Bindings     []RabbitMqBinding        `json:"bindings"`
+		Routes       map[string]RabbitMqRoute `json:"routes"`
+		DefaultRoute RabbitMqRoute            `json:"default_route"`
+	}
+
+	RabbitMqExchange struct {
+		Name       string     `json:"name"`
+		Kind       string     `json:"kind"`
+		Durable    bool       `json:"durable"`
+		AutoDelete bool       `json:"auto_delete"`
+		Internal   bool       `json:"internal"`
+		Arguments  amqp.Table `json:"arguments"`
+	}
+
+	RabbitMqQueue struct {
+		Name       string     `json:"name"`
+		Durable    bool       `json:"durable"`
+		AutoDelete bool       `json:"auto_delete"`
+		Exclusive  bool       `json:"exclusive"`
+		Arguments  amqp.Table `json:"arguments"`
+	}
+
+	RabbitMqBinding struct {
+		Queue      string     `json:"queue"`
+		Exchange   string     `json:"exchange"`
+		RoutingKey string     `json:"routing_key"`
+		Arguments  amqp.Table `json:"arguments"`
+	}
+
+	// RabbitMqRoute names the exchange an event is published to and its routing key
+	// template, in which {name}, {id} and {payload.<field>} are replaced by the event's values.
+	RabbitMqRoute struct {
+		Exchange   string `json:"exchange"`
+		RoutingKey string `json:"routing_key"`
+	}
+)
+
+var routingKeyPlaceholder = regexp.MustCompile(`\{(name|id|payload\.[^{}]+)\}`)
+
+// DefaultRabbitMqTopology declares nothing and publishes every event to amq.direct
+// with its name as routing key.
+func DefaultRabbitMqTopology() RabbitMqTopology {
+	return RabbitMqTopology{DefaultRoute: RabbitMqRoute{Exchange: "amq.direct", RoutingKey: "{name}"}}
+}
+
+// LoadRabbitMqTopology reads a topology from a JSON file. Fields left out keep the
+// defaults of DefaultRabbitMqTopology.
+func LoadRabbitMqTopology(path string) (RabbitMqTopology, error) {
+	topology := DefaultRabbitMqTopology()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return topology, err
+	}
+	if err := json.Unmarshal(content, &topology); err != nil {
+		return topology, fmt.Errorf("invalid RabbitMQ topology %s: %w", path, err)
+	}
+	return topology, topology.validate()
+}
+
+func (t RabbitMqTopology) validate() error {
+	for _, exchange := range t.Exchanges {
+		switch exchange.Kind {
+		case amqp.ExchangeDirect, amqp.ExchangeTopic, amqp.ExchangeFanout, amqp.ExchangeHeaders:
+		default:
+			return fmt.Errorf("exchange %s has unsupported kind %q", exchange.Name, exchange.Kind)
+		}
+	}
+	return nil
+}
+
+// Declare declares the exchanges, queues and bindings on the channel. Declaring is
+// idempotent, so it runs on every reconnection.
+func (t RabbitMqTopology) Declare(channel *amqp.Channel) error {
+	for _, exchange := range t.Exchanges {
+		err := channel.ExchangeDeclare(exchange.Name, exchange.Kind, exchange.Durable, exchange.AutoDelete, exchange.Internal, false, exchange.Arguments)
+		if err != nil {
+			return fmt.Errorf("declaring exchange %s: %w", exchange.Name, err)
+		}
+	}
+	for _, queue := range t.Queues {
+		_, err := channel.QueueDeclare(queue.Name, queue.Durable, queue.AutoDelete, queue.Exclusive, false, queue.Arguments)
+		if err != nil {
+			return fmt.Errorf("declaring queue %s: %w", queue.Name, err)
+		}
+	}
+	for _, binding := range t.Bindings {
+		err := channel.QueueBind(binding.Queue, binding.RoutingKey, binding.Exchange, false, binding.Arguments)
+		if err != nil {
+			return fmt.Errorf("binding queue %s to %s: %w", binding.Queue, binding.Exchange, err)
+		}
+	}
+	return nil
+}
+
+// Route returns the exchange and routing key an event is published with.
+func (t RabbitMqTopology) Route(event *Event) (exchange, routingKey string) {
+	route, ok := t.Routes[event.Name]
+	if !ok {
+		route = t.DefaultRoute
+	}
+	routingKey = routingKeyPlaceholder.ReplaceAllStringFunc(route.RoutingKey, func(placeholder string) string {
+		switch field := placeholder[1 : len(placeholder)-1]; field {
+		case "name":
+			return event.Name
+		case "id":
+			return event.ID
+		default:
+			return event.Payload[field[len("payload."):]]
+		}
+	})
+	return route.Exchange, routingKey
+}
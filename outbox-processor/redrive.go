@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// runRedrive implements the "redrive" subcommand: dead letters matching the given
+// filters are moved back to PENDING so the streams pick them up again.
+func runRedrive(ctx context.Context, args []string, outboxRepository OutboxRepository, deadLetterRepository DeadLetterRepository) error {
+	flags := flag.NewFlagSet("redrive", flag.ContinueOnError)
+	ids := flags.String("id", "", "comma separated ids of the dead letters to redrive")
+	name := flags.String("name", "", "redrive only dead letters of this event name")
+	from := flags.String("from", "", "redrive only records dead since this RFC 3339 time")
+	to := flags.String("to", "", "redrive only records dead until this RFC 3339 time")
+	all := flags.Bool("all", false, "redrive every dead letter when no other filter is given")
+	dryRun := flags.Bool("dry-run", false, "list the matching dead letters without redriving them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var filter DeadLetterFilter
+	if *ids != "" {
+		filter.Ids = strings.Split(*ids, ",")
+	}
+	filter.Name = *name
+	var err error
+	if filter.From, err = parseRedriveTime(*from); err != nil {
+		return err
+	}
+	if filter.To, err = parseRedriveTime(*to); err != nil {
+		return err
+	}
+	if len(filter.Ids) == 0 && filter.Name == "" && filter.From.IsZero() && filter.To.IsZero() && !*all {
+		return errors.New("redrive needs at least one of -id, -name, -from, -to or -all")
+	}
+
+	deadLetters, err := deadLetterRepository.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	redriven := 0
+	for _, deadLetter := range deadLetters {
+		if *dryRun {
+			slog.Info("Dead letter matches", "id", deadLetter.Id, "name", deadLetter.Name, "dead_at", deadLetter.DeadAt, "last_error", deadLetter.LastError)
+			continue
+		}
+		if err := redrive(ctx, deadLetter, outboxRepository, deadLetterRepository); err != nil {
+			slog.Error("Error redriving dead letter", "id", deadLetter.Id, "error", err)
+			continue
+		}
+		redriven++
+	}
+	slog.Info("Redrive finished", "matched", len(deadLetters), "redriven", redriven)
+	return nil
+}
+
+func redrive(ctx context.Context, deadLetter *DeadLetter, outboxRepository OutboxRepository, deadLetterRepository DeadLetterRepository) error {
+	outbox, err := outboxRepository.Get(ctx, deadLetter.Id)
+	if err != nil {
+		return err
+	}
+	if outbox == nil {
+		return errors.New("outbox record not found")
+	}
+	// A record can leave DEAD after being dead-lettered, e.g. retried because a sink
+	// failed, and be delivered since; redriving it would publish its event again.
+	if outbox.Status != OutboxStatusDead {
+		slog.Warn("Outbox record is no longer dead, deleting its stale dead letter", "id", outbox.Id, "status", outbox.Status)
+		if err := deadLetterRepository.Delete(ctx, deadLetter.Id); err != nil {
+			return err
+		}
+		return fmt.Errorf("outbox record is %s, not %s", outbox.Status, OutboxStatusDead)
+	}
+	outbox.Redrive()
+	if err := outboxRepository.Update(ctx, outbox); err != nil {
+		return err
+	}
+	return deadLetterRepository.Delete(ctx, deadLetter.Id)
+}
+
+func parseRedriveTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	Jitter      float64
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 10,
+		BaseBackoff: 5 * time.Second,
+		MaxBackoff:  10 * time.Minute,
+		Jitter:      0.2,
+	}
+}
+
+// Exhausted reports whether a record that already failed the given number of
+// attempts must not be retried anymore. A non-positive MaxAttempts disables the limit.
+func (p RetryPolicy) Exhausted(attempts int) bool {
+	return p.MaxAttempts > 0 && attempts >= p.MaxAttempts
+}
+
+// Backoff returns the delay before the next attempt of a record that failed
+// the given number of attempts: BaseBackoff doubled on every failure, capped
+// at MaxBackoff and spread by ±Jitter to avoid retrying records in lockstep.
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	backoff := p.BaseBackoff
+	for i := 1; i < attempts && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		delta := float64(backoff) * p.Jitter
+		backoff += time.Duration(delta * (2*rand.Float64() - 1))
+	}
+	return max(backoff, 0)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyExhausted(t *testing.T) {
+	for _, test := range []struct {
+		maxAttempts int
+		attempts    int
+		exhausted   bool
+	}{
+		{maxAttempts: 3, attempts: 1},
+		{maxAttempts: 3, attempts: 2},
+		{maxAttempts: 3, attempts: 3, exhausted: true},
+		{maxAttempts: 3, attempts: 4, exhausted: true},
+		{maxAttempts: 0, attempts: 100},
+		{maxAttempts: -1, attempts: 100},
+	} {
+		policy := RetryPolicy{MaxAttempts: test.maxAttempts}
+		if got := policy.Exhausted(test.attempts); got != test.exhausted {
+			t.Errorf("MaxAttempts %d: Exhausted(%d) = %v, want %v", test.maxAttempts, test.attempts, got, test.exhausted)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	for _, test := range []struct {
+		attempts int
+		backoff  time.Duration
+	}{
+		{attempts: 1, backoff: time.Second},
+		{attempts: 2, backoff: 2 * time.Second},
+		{attempts: 3, backoff: 4 * time.Second},
+		{attempts: 4, backoff: 8 * time.Second},
+		{attempts: 5, backoff: 10 * time.Second},
+		{attempts: 50, backoff: 10 * time.Second},
+	} {
+		if got := policy.Backoff(test.attempts); got != test.backoff {
+			t.Errorf("Backoff(%d) = %v, want %v", test.attempts, got, test.backoff)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffJitter(t *testing.T) {
+	policy := RetryPolicy{BaseBackoff: 10 * time.Second, MaxBackoff: time.Minute, Jitter: 0.2}
+	for range 100 {
+		if got := policy.Backoff(1); got < 8*time.Second || got > 12*time.Second {
+			t.Fatalf("Backoff(1) = %v, want within 20%% of 10s", got)
+		}
+	}
+}
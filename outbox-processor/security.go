@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// tlsConfigFromEnv builds the TLS configuration of a client from the variables
+// starting with prefix, e.g. OUTBOX_KAFKA:
+//
+//	<prefix>_TLS                       enables TLS with the system roots
+//	<prefix>_TLS_CA_FILE               PEM bundle of the CAs to trust instead
+//	<prefix>_TLS_CERT_FILE, _KEY_FILE  client certificate and key for mutual TLS
+//	<prefix>_TLS_SERVER_NAME           name to verify the server certificate against
+//	<prefix>_TLS_INSECURE_SKIP_VERIFY  skips verification, for local testing only
+//
+// It returns nil when none of them asks for TLS.
+func tlsConfigFromEnv(prefix string) (*tls.Config, error) {
+	caFile := envString(prefix+"_TLS_CA_FILE", "")
+	certFile := envString(prefix+"_TLS_CERT_FILE", "")
+	keyFile := envString(prefix+"_TLS_KEY_FILE", "")
+	if !envBool(prefix+"_TLS", false) && caFile == "" && certFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         envString(prefix+"_TLS_SERVER_NAME", ""),
+		InsecureSkipVerify: envBool(prefix+"_TLS_INSECURE_SKIP_VERIFY", false),
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s_TLS_CA_FILE: %w", prefix, err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s_TLS_CA_FILE holds no PEM certificate", prefix)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("%s_TLS_CERT_FILE and %s_TLS_KEY_FILE must be set together", prefix, prefix)
+		}
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s client certificate: %w", prefix, err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// envSecret reads a credential from the file named by <key>_FILE, as mounted by
+// Docker and Kubernetes secrets, or else from the variable itself.
+func envSecret(key, fallback string) (string, error) {
+	if path := envString(key+"_FILE", ""); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading %s_FILE: %w", key, err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+	return envString(key, fallback), nil
+}
+
+// credentialsFromEnv reads a username and password pair stored under the given prefix.
+func credentialsFromEnv(prefix string) (username, password string, err error) {
+	username, userErr := envSecret(prefix+"_USERNAME", "")
+	password, passwordErr := envSecret(prefix+"_PASSWORD", "")
+	return username, password, errors.Join(userErr, passwordErr)
+}
+
+// kafkaSecurityFromEnv reads the TLS settings under OUTBOX_KAFKA and the SASL
+// mechanism from OUTBOX_KAFKA_SASL_MECHANISM, authenticating with
+// OUTBOX_KAFKA_SASL_USERNAME and OUTBOX_KAFKA_SASL_PASSWORD.
+func kafkaSecurityFromEnv() (KafkaSecurity, error) {
+	tlsConfig, err := tlsConfigFromEnv("OUTBOX_KAFKA")
+	if err != nil {
+		return KafkaSecurity{}, err
+	}
+	security := KafkaSecurity{TLS: tlsConfig, SaslMechanism: strings.ToUpper(envString("OUTBOX_KAFKA_SASL_MECHANISM", ""))}
+	if security.SaslMechanism != "" {
+		security.Username, security.Password, err = credentialsFromEnv("OUTBOX_KAFKA_SASL")
+	}
+	return security, err
+}
+
+// rabbitMqServerFromEnv reads the broker URL from OUTBOX_RABBITMQ_URL, replacing
+// its user info with OUTBOX_RABBITMQ_USERNAME and OUTBOX_RABBITMQ_PASSWORD when
+// they are set, and the TLS settings under OUTBOX_RABBITMQ. An amqps:// URL alone
+// is enough to connect over TLS with the system roots.
+func rabbitMqServerFromEnv() (string, *tls.Config, error) {
+	server, err := envSecret("OUTBOX_RABBITMQ_URL", RabbitMqServer)
+	if err != nil {
+		return "", nil, err
+	}
+	parsed, err := urlWithCredentials("OUTBOX_RABBITMQ_URL", server, "OUTBOX_RABBITMQ")
+	if err != nil {
+		return "", nil, err
+	}
+	tlsConfig, err := tlsConfigFromEnv("OUTBOX_RABBITMQ")
+	if err != nil {
+		return "", nil, err
+	}
+	// The client only negotiates TLS for amqps:// URLs.
+	if tlsConfig != nil && parsed.Scheme == "amqp" {
+		parsed.Scheme = "amqps"
+	}
+	return parsed.String(), tlsConfig, nil
+}
+
+// postgresServerFromEnv reads the connection URL from OUTBOX_POSTGRES_URL, with the
+// user info replaced by OUTBOX_POSTGRES_USERNAME and OUTBOX_POSTGRES_PASSWORD when
+// they are set. TLS is configured through the URL, e.g. sslmode=verify-full&sslrootcert=ca.pem.
+func postgresServerFromEnv() (string, error) {
+	server, err := envSecret("OUTBOX_POSTGRES_URL", PostgresServer)
+	if err != nil {
+		return "", err
+	}
+	parsed, err := urlWithCredentials("OUTBOX_POSTGRES_URL", server, "OUTBOX_POSTGRES")
+	if err != nil {
+		return "", err
+	}
+	return parsed.String(), nil
+}
+
+// mySqlConfigFromEnv reads the DSN from OUTBOX_MYSQL_DSN, e.g.
+// user:password@tcp(localhost:3306)/outbox, with the credentials replaced by
+// OUTBOX_MYSQL_USERNAME and OUTBOX_MYSQL_PASSWORD when they are set, and the TLS
+// settings under OUTBOX_MYSQL.
+func mySqlConfigFromEnv() (*mysqldriver.Config, error) {
+	dsn, err := envSecret("OUTBOX_MYSQL_DSN", MySqlServer)
+	if err != nil {
+		return nil, err
+	}
+	config, err := mysqldriver.ParseDSN(dsn)
+	if err != nil {
+		// The DSN may hold a password, so it is left out of the error.
+		return nil, errors.New("invalid OUTBOX_MYSQL_DSN")
+	}
+	username, password, err := credentialsFromEnv("OUTBOX_MYSQL")
+	if err != nil {
+		return nil, err
+	}
+	if username != "" {
+		config.User, config.Passwd = username, password
+	}
+	tlsConfig, err := tlsConfigFromEnv("OUTBOX_MYSQL")
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		config.TLS = tlsConfig
+	}
+	// The repository scans times as UTC and tells conflicts apart from updates
+	// that change nothing by the number of rows found.
+	config.ParseTime, config.Loc, config.ClientFoundRows = true, time.UTC, true
+	return config, nil
+}
+
+// urlWithCredentials parses the URL read from key, replacing its user info with
+// the credentials stored under prefix when there are any.
+func urlWithCredentials(key, server, prefix string) (*url.URL, error) {
+	parsed, err := url.Parse(server)
+	if err != nil {
+		// The URL may hold a password, so it is left out of the error.
+		return nil, fmt.Errorf("invalid %s", key)
+	}
+	username, password, err := credentialsFromEnv(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if username != "" {
+		parsed.User = url.UserPassword(username, password)
+	}
+	return parsed, nil
+}
+
+// mongoClientOptionsFromEnv reads the connection string from OUTBOX_MONGO_URI, the
+// credentials from OUTBOX_MONGO_USERNAME and OUTBOX_MONGO_PASSWORD, checked
+// against OUTBOX_MONGO_AUTH_SOURCE, and the TLS settings under OUTBOX_MONGO.
+func mongoClientOptionsFromEnv() (*options.ClientOptions, error) {
+	uri, err := envSecret("OUTBOX_MONGO_URI", MongoServer)
+	if err != nil {
+		return nil, err
+	}
+	clientOptions := options.Client().ApplyURI(uri)
+	username, password, err := credentialsFromEnv("OUTBOX_MONGO")
+	if err != nil {
+		return nil, err
+	}
+	if username != "" {
+		clientOptions.SetAuth(options.Credential{
+			Username:   username,
+			Password:   password,
+			AuthSource: envString("OUTBOX_MONGO_AUTH_SOURCE", ""),
+		})
+	}
+	tlsConfig, err := tlsConfigFromEnv("OUTBOX_MONGO")
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		clientOptions.SetTLSConfig(tlsConfig)
+	}
+	return clientOptions, nil
+}
+
+// awsConfigFromEnv reads the region from OUTBOX_AWS_REGION and the endpoint from
+// OUTBOX_AWS_ENDPOINT, which may be set empty to reach AWS itself. Credentials
+// come from OUTBOX_AWS_ACCESS_KEY_ID, OUTBOX_AWS_SECRET_ACCESS_KEY and
+// OUTBOX_AWS_SESSION_TOKEN when set, and from the SDK's default chain otherwise:
+// the AWS_* variables, the shared credentials file or the instance role.
+func awsConfigFromEnv() (*aws.Config, error) {
+	config := &aws.Config{
+		Region:           aws.String(envString("OUTBOX_AWS_REGION", AwsRegion)),
+		S3ForcePathStyle: aws.Bool(true),
+	}
+	endpoint, ok := os.LookupEnv("OUTBOX_AWS_ENDPOINT")
+	if !ok {
+		endpoint = AwsEndpoint
+	}
+	if endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	}
+	accessKeyId, err := envSecret("OUTBOX_AWS_ACCESS_KEY_ID", "")
+	if err != nil {
+		return nil, err
+	}
+	secretAccessKey, err := envSecret("OUTBOX_AWS_SECRET_ACCESS_KEY", "")
+	if err != nil {
+		return nil, err
+	}
+	sessionToken, err := envSecret("OUTBOX_AWS_SESSION_TOKEN", "")
+	if err != nil {
+		return nil, err
+	}
+	if accessKeyId != "" {
+		config.Credentials = credentials.NewStaticCredentials(accessKeyId, secretAccessKey, sessionToken)
+	}
+	return config, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// sqlOutboxColumns lists the columns scanned by scanOutbox, in its order, for the
+// SQL backends. Optional text columns are NULL rather than empty.
+const sqlOutboxColumns = `id, name, COALESCE(ordering_key, ''), payload, headers, status, created_at,
+	processed_at, last_attempt_time, attempts, next_attempt_at, COALESCE(last_error, ''), history,
+	COALESCE(owner, ''), lease_expires_at, version`
+
+type (
+	// rowScanner is implemented by both *sql.Row and *sql.Rows.
+	rowScanner interface {
+		Scan(dest ...any) error
+	}
+
+	// sqlExecutor is implemented by both *sql.DB and *sql.Tx.
+	sqlExecutor interface {
+		ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	}
+)
+
+func scanOutbox(row rowScanner) (*Outbox, error) {
+	var outbox Outbox
+	var headers, history []byte
+	err := row.Scan(
+		&outbox.Id, &outbox.Name, &outbox.OrderingKey, &outbox.Payload, &headers, &outbox.Status, &outbox.CreatedAt,
+		&outbox.ProcessedAt, &outbox.LastAttemptTime, &outbox.Attempts, &outbox.NextAttemptAt, &outbox.LastError, &history,
+		&outbox.Owner, &outbox.LeaseExpiresAt, &outbox.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(headers) > 0 {
+		if err := json.Unmarshal(headers, &outbox.Headers); err != nil {
+			return nil, fmt.Errorf("invalid headers of outbox record %s: %w", outbox.Id, err)
+		}
+	}
+	if len(history) > 0 {
+		if err := json.Unmarshal(history, &outbox.History); err != nil {
+			return nil, fmt.Errorf("invalid history of outbox record %s: %w", outbox.Id, err)
+		}
+	}
+	return &outbox, nil
+}
+
+func scanOutboxes(rows *sql.Rows) ([]*Outbox, error) {
+	defer rows.Close()
+	var outboxes []*Outbox
+	for rows.Next() {
+		outbox, err := scanOutbox(rows)
+		if err != nil {
+			return nil, err
+		}
+		outboxes = append(outboxes, outbox)
+	}
+	return outboxes, rows.Err()
+}
+
+// historyColumn encodes an attempt history for its JSON column, NULL when empty.
+func historyColumn(history []Attempt) (any, error) {
+	if len(history) == 0 {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(history)
+	if err != nil {
+		return nil, err
+	}
+	return string(encoded), nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	_ "modernc.org/sqlite"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	SqliteDatabasePath       = "outbox.db"
+	DefaultSqliteBusyTimeout = 5 * time.Second
+
+	// sqliteTimeLayout is how the driver writes times with _time_format=sqlite.
+	sqliteTimeLayout = "2006-01-02 15:04:05.999999999-07:00"
+)
+
+type (
+	// SqliteOutboxRepository stores records in the table created by migrations/sqlite.
+	// Times are written in UTC, so their text compares in time order.
+	SqliteOutboxRepository struct {
+		db        *sql.DB
+		tableName string
+	}
+
+	SqliteDeadLetterRepository struct {
+		db        *sql.DB
+		tableName string
+	}
+)
+
+// OpenSqlite opens the database file at path in WAL mode, which lets readers carry
+// on while a record is written. SQLite has a single writer at a time: connections
+// wait up to busyTimeout for the lock rather than failing right away, and
+// transactions take it when they begin, since a transaction that read first cannot
+// wait for it when it starts writing and fails with SQLITE_BUSY instead.
+func OpenSqlite(path string, busyTimeout time.Duration) (*sql.DB, error) {
+	query := url.Values{}
+	// The busy timeout comes first, switching to WAL takes the lock too.
+	query.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", busyTimeout.Milliseconds()))
+	query.Add("_pragma", "journal_mode(WAL)")
+	query.Add("_pragma", "synchronous(NORMAL)")
+	query.Set("_txlock", "immediate")
+	query.Set("_time_format", "sqlite")
+	return sql.Open("sqlite", "file:"+path+"?"+query.Encode())
+}
+
+func NewSqliteOutboxRepository(db *sql.DB, tableName string) *SqliteOutboxRepository {
+	return &SqliteOutboxRepository{db: db, tableName: sqliteIdentifier(tableName)}
+}
+
+func NewSqliteDeadLetterRepository(db *sql.DB, tableName string) DeadLetterRepository {
+	return &SqliteDeadLetterRepository{db: db, tableName: sqliteIdentifier(tableName)}
+}
+
+func (r *SqliteOutboxRepository) Update(ctx context.Context, outbox *Outbox) error {
+	if err := r.update(ctx, r.db, outbox); err != nil {
+		return err
+	}
+	outbox.Version++
+	return nil
+}
+
+// UpdateBatch runs the updates in one transaction, which takes the write lock once
+// for the whole batch.
+func (r *SqliteOutboxRepository) UpdateBatch(ctx context.Context, outboxes []*Outbox) []error {
+	errs := make([]error, len(outboxes))
+	if len(outboxes) == 0 {
+		return errs
+	}
+	failAll := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return failAll(err)
+	}
+	defer tx.Rollback()
+	for i, outbox := range outboxes {
+		err := r.update(ctx, tx, outbox)
+		if err != nil && !errors.Is(err, ErrConcurrentModification) {
+			return failAll(err)
+		}
+		errs[i] = err
+	}
+	if err := tx.Commit(); err != nil {
+		return failAll(err)
+	}
+	for i, outbox := range outboxes {
+		if errs[i] == nil {
+			outbox.Version++
+		}
+	}
+	return errs
+}
+
+func (r *SqliteOutboxRepository) update(ctx context.Context, db sqlExecutor, outbox *Outbox) error {
+	history, err := historyColumn(outbox.History)
+	if err != nil {
+		return err
+	}
+	result, err := db.ExecContext(ctx, `UPDATE `+r.tableName+` SET
+		status = ?, processed_at = ?, last_attempt_time = ?, attempts = ?, next_attempt_at = ?,
+		last_error = NULLIF(?, ''), history = ?, owner = NULLIF(?, ''), lease_expires_at = ?,
+		version = version + 1
+		WHERE id = ? AND version = ?`,
+		outbox.Status, sqliteTime(outbox.ProcessedAt), sqliteTime(outbox.LastAttemptTime), outbox.Attempts, sqliteTime(outbox.NextAttemptAt),
+		outbox.LastError, history, outbox.Owner, sqliteTime(outbox.LeaseExpiresAt), outbox.Id, outbox.Version,
+	)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return ErrConcurrentModification
+	}
+	return nil
+}
+
+func (r *SqliteOutboxRepository) Get(ctx context.Context, id string) (*Outbox, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+sqlOutboxColumns+` FROM `+r.tableName+` WHERE id = ?`, id)
+	outbox, err := scanOutbox(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return outbox, err
+}
+
+// Claim also succeeds on a record owner already holds, at the same version, since
+// PollingStream claims the records before delivering them; the lease is renewed.
+func (r *SqliteOutboxRepository) Claim(ctx context.Context, outbox *Outbox, owner string, lease time.Duration) (*Outbox, error) {
+	now := time.Now().UTC()
+	claimed := outbox.claimedBy(owner, now.Add(lease))
+	result, err := r.db.ExecContext(ctx, `UPDATE `+r.tableName+` SET
+		status = ?, owner = ?, lease_expires_at = ?, version = version + 1
+		WHERE id = ? AND version = ? AND (
+			status IN ('`+OutboxStatusPending+`', '`+OutboxStatusError+`')
+			OR (status = '`+OutboxStatusInProgress+`' AND (lease_expires_at IS NULL OR lease_expires_at < ? OR owner = ?))
+		)`,
+		claimed.Status, claimed.Owner, claimed.LeaseExpiresAt, outbox.Id, outbox.Version, now, owner,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claimedRows, err := result.RowsAffected(); err != nil || claimedRows == 0 {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// ClaimDue claims up to limit records that are due, oldest first, on behalf of owner.
+// The statement holds the write lock throughout, so processors sharing the database
+// file never claim the same record.
+func (r *SqliteOutboxRepository) ClaimDue(ctx context.Context, owner string, lease time.Duration, limit int) ([]*Outbox, error) {
+	now := time.Now().UTC()
+	rows, err := r.db.QueryContext(ctx, `UPDATE `+r.tableName+` SET
+		status = '`+OutboxStatusInProgress+`', owner = ?, lease_expires_at = ?, version = version + 1
+		WHERE id IN (
+			SELECT id FROM `+r.tableName+`
+			WHERE (status IN ('`+OutboxStatusPending+`', '`+OutboxStatusError+`') AND (next_attempt_at IS NULL OR next_attempt_at <= ?))
+				OR (status = '`+OutboxStatusInProgress+`' AND (lease_expires_at IS NULL OR lease_expires_at < ?))
+			ORDER BY created_at
+			LIMIT ?
+		)
+		RETURNING `+sqlOutboxColumns,
+		owner, now.Add(lease), now, now, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	claimed, err := scanOutboxes(rows)
+	if err != nil {
+		return nil, err
+	}
+	// RETURNING does not keep the order of the subquery.
+	slices.SortFunc(claimed, func(a, b *Outbox) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return claimed, nil
+}
+
+// NextDueAt returns when the earliest record waiting for a retry, a postponed turn
+// or an expired lease becomes due, or nil when no record is waiting. The driver
+// only parses times from columns declared as such, so MIN returns text.
+func (r *SqliteOutboxRepository) NextDueAt(ctx context.Context) (*time.Time, error) {
+	var dueAt sql.NullString
+	err := r.db.QueryRowContext(ctx, `SELECT MIN(CASE
+			WHEN status = '`+OutboxStatusInProgress+`' THEN lease_expires_at
+			ELSE COALESCE(next_attempt_at, created_at)
+		END) FROM `+r.tableName+`
+		WHERE status IN ('`+OutboxStatusPending+`', '`+OutboxStatusError+`', '`+OutboxStatusInProgress+`')`,
+	).Scan(&dueAt)
+	if err != nil || !dueAt.Valid {
+		return nil, err
+	}
+	parsed, err := time.Parse(sqliteTimeLayout, dueAt.String)
+	if err != nil {
+		return nil, fmt.Errorf("invalid due time %q: %w", dueAt.String, err)
+	}
+	return &parsed, nil
+}
+
+func (r *SqliteOutboxRepository) FindStuck(ctx context.Context, before time.Time, limit int) ([]*Outbox, error) {
+	before = before.UTC()
+	rows, err := r.db.QueryContext(ctx, `SELECT `+sqlOutboxColumns+` FROM `+r.tableName+`
+		WHERE (status = '`+OutboxStatusPending+`' AND created_at < ?1 AND (next_attempt_at IS NULL OR next_attempt_at < ?1))
+			OR (status = '`+OutboxStatusError+`' AND (next_attempt_at IS NULL OR next_attempt_at < ?1))
+			OR (status = '`+OutboxStatusInProgress+`' AND (lease_expires_at IS NULL OR lease_expires_at < ?2))
+		ORDER BY created_at
+		LIMIT ?3`,
+		before, time.Now().UTC(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanOutboxes(rows)
+}
+
+func (r *SqliteOutboxRepository) FindUnfinishedBefore(ctx context.Context, outbox *Outbox) (*Outbox, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+sqlOutboxColumns+` FROM `+r.tableName+`
+		WHERE ordering_key = ? AND created_at < ?
+			AND status NOT IN ('`+OutboxStatusProcessed+`', '`+OutboxStatusDead+`')
+		ORDER BY created_at
+		LIMIT 1`,
+		outbox.OrderingKey, outbox.CreatedAt.UTC(),
+	)
+	earliest, err := scanOutbox(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return earliest, err
+}
+
+func (r *SqliteDeadLetterRepository) Send(ctx context.Context, deadLetter *DeadLetter) error {
+	history, err := historyColumn(deadLetter.History)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, `INSERT INTO `+r.tableName+`
+		(id, name, payload, created_at, dead_at, attempts, last_error, history, emitter)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			name = excluded.name, payload = excluded.payload, created_at = excluded.created_at,
+			dead_at = excluded.dead_at, attempts = excluded.attempts, last_error = excluded.last_error,
+			history = excluded.history, emitter = excluded.emitter`,
+		deadLetter.Id, deadLetter.Name, deadLetter.Payload, deadLetter.CreatedAt.UTC(), deadLetter.DeadAt.UTC(),
+		deadLetter.Attempts, deadLetter.LastError, history, deadLetter.Emitter,
+	)
+	return err
+}
+
+func (r *SqliteDeadLetterRepository) Find(ctx context.Context, filter DeadLetterFilter) ([]*DeadLetter, error) {
+	var conditions []string
+	var args []any
+	if len(filter.Ids) > 0 {
+		conditions = append(conditions, "id IN ("+sqlPlaceholders(len(filter.Ids))+")")
+		for _, id := range filter.Ids {
+			args = append(args, id)
+		}
+	}
+	if filter.Name != "" {
+		conditions = append(conditions, "name = ?")
+		args = append(args, filter.Name)
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "dead_at >= ?")
+		args = append(args, filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "dead_at <= ?")
+		args = append(args, filter.To.UTC())
+	}
+	query := `SELECT id, name, payload, created_at, dead_at, attempts, last_error, history, emitter FROM ` + r.tableName
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var deadLetters []*DeadLetter
+	for rows.Next() {
+		var deadLetter DeadLetter
+		var history []byte
+		err := rows.Scan(
+			&deadLetter.Id, &deadLetter.Name, &deadLetter.Payload, &deadLetter.CreatedAt, &deadLetter.DeadAt,
+			&deadLetter.Attempts, &deadLetter.LastError, &history, &deadLetter.Emitter,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if len(history) > 0 {
+			if err := json.Unmarshal(history, &deadLetter.History); err != nil {
+				return nil, fmt.Errorf("invalid history of dead letter %s: %w", deadLetter.Id, err)
+			}
+		}
+		deadLetters = append(deadLetters, &deadLetter)
+	}
+	return deadLetters, rows.Err()
+}
+
+func (r *SqliteDeadLetterRepository) Delete(ctx context.Context, id string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM `+r.tableName+` WHERE id = ?`, id)
+	return err
+}
+
+func sqliteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func sqliteTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
+}
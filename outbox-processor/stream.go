@@ -1,5 +1,189 @@
 package main
 
+import (
+	"context"
+	"sync"
+	"time"
+)
+
 type OutboxStream interface {
-	FetchEvents() (chan string, error)
+	// FetchEvents starts reading the stream until ctx is done. It delivers the records
+	// as last seen by the stream, which callers claim before handling. The returned
+	// channel is closed once every reader has stopped and flushed its position.
+	FetchEvents(ctx context.Context) (chan *Outbox, error)
+	// Errors reports failures the stream cannot recover from, after which it stops delivering events.
+	Errors() <-chan error
+}
+
+// AcknowledgingStream is implemented by streams that must learn when the records
+// they delivered have been handled, e.g. to only then move their position past them.
+type AcknowledgingStream interface {
+	OutboxStream
+	// Ack reports that a delivered record, the same pointer as delivered, has been
+	// handled. Records the stream did not deliver are ignored.
+	Ack(outbox *Outbox)
+}
+
+// awaitsHandling reports whether a record seen by a stream still has to be handed
+// over: it is pending, failed, or its claim has expired and can be reclaimed. Records
+// under a live claim do not, which is how the stream sees this processor's own claims
+// come back.
+func awaitsHandling(outbox *Outbox) bool {
+	return outbox.IsClaimable(time.Now())
+}
+
+// dueIn returns how long a record has to wait before it can be claimed: failed or
+// postponed records wait for their next attempt.
+func dueIn(outbox *Outbox) time.Duration {
+	if outbox.NextAttemptAt == nil {
+		return 0
+	}
+	return max(time.Until(*outbox.NextAttemptAt), 0)
+}
+
+// eventChannel is the channel a stream delivers records on, shared by its readers. It
+// stops accepting ids once ctx is done and is closed after every reader started
+// with goTracked, including the one handing over delayed records, has returned.
+type eventChannel struct {
+	ctx          context.Context
+	events       chan *Outbox
+	readers      sync.WaitGroup
+	delayed      *delayQueue
+	startDelayed sync.Once
+}
+
+func newEventChannel(ctx context.Context) *eventChannel {
+	return &eventChannel{ctx: ctx, events: make(chan *Outbox), delayed: newDelayQueue(DefaultDelayQueueSize)}
+}
+
+// goTracked runs a reader that the channel waits for before closing.
+func (c *eventChannel) goTracked(reader func()) {
+	c.readers.Add(1)
+	go func() {
+		defer c.readers.Done()
+		reader()
+	}()
+}
+
+// closeWhenDone closes the channel once every tracked reader has returned. It must
+// be called after the first reader has been started.
+func (c *eventChannel) closeWhenDone() {
+	go func() {
+		c.readers.Wait()
+		close(c.events)
+	}()
+}
+
+// send delivers a record, reporting false when the stream is being stopped instead.
+func (c *eventChannel) send(outbox *Outbox) bool {
+	select {
+	case c.events <- outbox:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// dispatch delivers a record right away when it is due, or parks it in the delay
+// queue otherwise. Delivering blocks while the consumer is busy, and reports false
+// when the stream is stopped before the record was taken; parking never blocks. A
+// record that does not await handling is not delivered, and any copy of it still
+// parked is dropped.
+func (c *eventChannel) dispatch(outbox *Outbox) bool {
+	if !awaitsHandling(outbox) {
+		c.delayed.drop(outbox.Id)
+		return true
+	}
+	delay := dueIn(outbox)
+	if delay == 0 {
+		c.delayed.drop(outbox.Id)
+		return c.send(outbox)
+	}
+	c.startDelayed.Do(func() {
+		c.goTracked(func() { c.delayed.run(c.ctx, c.send) })
+	})
+	c.delayed.add(outbox, time.Now().Add(delay))
+	return true
+}
+
+// onDropped registers a function told about every record parked by dispatch that
+// leaves the delay queue without being delivered, replaced by a newer copy or
+// dropped to make room. It must be called before the first dispatch.
+func (c *eventChannel) onDropped(dropped func(outbox *Outbox)) {
+	c.delayed.dropped = dropped
+}
+
+// sleep waits for the given duration, reporting false when ctx is done first.
+func sleep(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// mergedStream fans several streams into one, e.g. a change stream and the sweeper.
+type mergedStream struct {
+	streams []OutboxStream
+	errors  chan error
+}
+
+func MergeStreams(streams ...OutboxStream) OutboxStream {
+	return &mergedStream{streams: streams, errors: make(chan error, len(streams))}
+}
+
+// FetchEvents starts every stream, or none: when one fails to start, those already
+// started are stopped and their remaining records discarded.
+func (m *mergedStream) FetchEvents(ctx context.Context) (chan *Outbox, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	started := make([]chan *Outbox, 0, len(m.streams))
+	for _, stream := range m.streams {
+		streamEvents, err := stream.FetchEvents(ctx)
+		if err != nil {
+			cancel()
+			for _, events := range started {
+				go func() {
+					for range events {
+					}
+				}()
+			}
+			return nil, err
+		}
+		started = append(started, streamEvents)
+	}
+	merged := newEventChannel(ctx)
+	for i, streamEvents := range started {
+		// Forward everything the stream delivers, even after ctx is done, so the
+		// stream can close its channel and the merged one closes after it.
+		merged.goTracked(func() {
+			for outbox := range streamEvents {
+				merged.events <- outbox
+			}
+		})
+		go func(streamErrors <-chan error) {
+			for err := range streamErrors {
+				m.errors <- err
+			}
+		}(m.streams[i].Errors())
+	}
+	merged.closeWhenDone()
+	// The streams stop with the parent context; the derived one only has to be released.
+	context.AfterFunc(ctx, cancel)
+	return merged.events, nil
+}
+
+func (m *mergedStream) Errors() <-chan error {
+	return m.errors
+}
+
+// Ack passes the acknowledgement on to every stream that wants one.
+func (m *mergedStream) Ack(outbox *Outbox) {
+	for _, stream := range m.streams {
+		if acknowledging, ok := stream.(AcknowledgingStream); ok {
+			acknowledging.Ack(outbox)
+		}
+	}
 }
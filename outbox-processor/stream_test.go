@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDispatchHandsOverClaimableRecords(t *testing.T) {
+	expired := time.Now().Add(-time.Second)
+	live := time.Now().Add(time.Minute)
+	for _, test := range []struct {
+		name      string
+		outbox    *Outbox
+		delivered bool
+	}{
+		{name: "pending", outbox: &Outbox{Id: "1", Status: OutboxStatusPending}, delivered: true},
+		{name: "failed and due", outbox: &Outbox{Id: "1", Status: OutboxStatusError, NextAttemptAt: &expired}, delivered: true},
+		{name: "expired claim", outbox: &Outbox{Id: "1", Status: OutboxStatusInProgress, LeaseExpiresAt: &expired}, delivered: true},
+		{name: "own claim echoed back", outbox: &Outbox{Id: "1", Status: OutboxStatusInProgress, LeaseExpiresAt: &live}},
+		{name: "processed", outbox: &Outbox{Id: "1", Status: OutboxStatusProcessed}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			events := newEventChannel(ctx)
+			go events.dispatch(test.outbox)
+
+			select {
+			case outbox := <-events.events:
+				if !test.delivered {
+					t.Errorf("record %s was delivered", outbox.Status)
+				}
+			case <-ctx.Done():
+				if test.delivered {
+					t.Error("record was not delivered")
+				}
+			}
+		})
+	}
+}
+
+func TestDispatchDropsParkedCopyOnceClaimed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := newEventChannel(ctx)
+	later := time.Now().Add(time.Hour)
+	live := time.Now().Add(time.Minute)
+
+	events.dispatch(&Outbox{Id: "1", Status: OutboxStatusError, NextAttemptAt: &later})
+	if events.delayed.remove("1") == nil {
+		t.Fatal("failed record due later was not parked")
+	}
+	events.dispatch(&Outbox{Id: "1", Status: OutboxStatusError, NextAttemptAt: &later})
+	events.dispatch(&Outbox{Id: "1", Status: OutboxStatusInProgress, LeaseExpiresAt: &live})
+	if parked := events.delayed.remove("1"); parked != nil {
+		t.Errorf("parked copy %s survived the claim", parked.Status)
+	}
+}
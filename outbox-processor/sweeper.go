@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const (
+	DefaultSweepInterval  = time.Minute
+	DefaultSweepThreshold = 5 * time.Minute
+	DefaultSweepBatchSize = 100
+)
+
+// Sweeper is an OutboxStream that periodically looks for records the change
+// notifications missed, still PENDING or ERROR well after they were due or
+// IN_PROGRESS under an expired lease, and feeds them back into the pipeline.
+type Sweeper struct {
+	outboxRepository OutboxRepository
+	interval         time.Duration
+	threshold        time.Duration
+	batchSize        int
+	errors           chan error
+}
+
+func NewSweeper(outboxRepository OutboxRepository, interval, threshold time.Duration, batchSize int) *Sweeper {
+	return &Sweeper{
+		outboxRepository: outboxRepository,
+		interval:         interval,
+		threshold:        threshold,
+		batchSize:        batchSize,
+		errors:           make(chan error),
+	}
+}
+
+func (s *Sweeper) FetchEvents(ctx context.Context) (chan *Outbox, error) {
+	events := newEventChannel(ctx)
+	events.goTracked(func() { s.run(ctx, events) })
+	events.closeWhenDone()
+	return events.events, nil
+}
+
+// Errors never reports anything: a failed sweep is logged and tried again on the next tick.
+func (s *Sweeper) Errors() <-chan error {
+	return s.errors
+}
+
+func (s *Sweeper) run(ctx context.Context, events *eventChannel) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweep(ctx, events)
+		}
+	}
+}
+
+func (s *Sweeper) sweep(ctx context.Context, events *eventChannel) {
+	sweeperRuns.Add(1)
+	stuck, err := s.outboxRepository.FindStuck(ctx, time.Now().Add(-s.threshold), s.batchSize)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		sweeperErrors.Add(1)
+		slog.Error("Error sweeping stuck outbox records", "error", err)
+		return
+	}
+	for _, outbox := range stuck {
+		if !events.send(outbox) {
+			return
+		}
+		sweeperRescued.Add(outbox.Status, 1)
+	}
+	if len(stuck) > 0 {
+		slog.Warn("Sweeper rescued stuck outbox records", "count", len(stuck))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultQueueSize   = 100
+	DefaultBatchSize   = 1
+	DefaultBatchLinger = 10 * time.Millisecond
+)
+
+var DefaultWorkers = runtime.NumCPU()
+
+// WorkerPool processes the records delivered by a stream on a fixed number of
+// workers, each fed through its own bounded queue. Records are routed by the
+// ordering policy so that records of the same key always go to the same worker.
+// While a queue is full the pool stops reading the stream, which holds its
+// readers back instead of buffering without limit.
+//
+// Each worker hands records over in batches of up to batchSize, waiting at most
+// linger for a batch to fill up once its first record arrived.
+type WorkerPool struct {
+	queues    []chan *Outbox
+	batchSize int
+	linger    time.Duration
+	ordering  OrderingPolicy
+	process   func(ctx context.Context, outboxes []*Outbox)
+}
+
+func NewWorkerPool(workers, queueSize, batchSize int, linger time.Duration, ordering OrderingPolicy, process func(ctx context.Context, outboxes []*Outbox)) *WorkerPool {
+	workers = max(workers, 1)
+	queues := make([]chan *Outbox, workers)
+	for i := range queues {
+		queues[i] = make(chan *Outbox, max(queueSize/workers, 1))
+	}
+	return &WorkerPool{
+		queues:    queues,
+		batchSize: max(batchSize, 1),
+		linger:    linger,
+		ordering:  ordering,
+		process:   process,
+	}
+}
+
+// Run processes events until the channel is closed and every queued record has been handled.
+func (p *WorkerPool) Run(ctx context.Context, events <-chan *Outbox) {
+	var workers sync.WaitGroup
+	for _, queue := range p.queues {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			p.work(ctx, queue)
+		}()
+	}
+	for outbox := range events {
+		queueDepth.Add(1)
+		p.queue(outbox) <- outbox
+	}
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	workers.Wait()
+}
+
+func (p *WorkerPool) work(ctx context.Context, queue <-chan *Outbox) {
+	for outbox := range queue {
+		queueDepth.Add(-1)
+		batch := p.fill(queue, []*Outbox{outbox})
+		busyWorkers.Add(1)
+		p.process(ctx, batch)
+		busyWorkers.Add(-1)
+	}
+}
+
+// fill adds queued records to the batch until it is full, the linger time is up or the queue is closed.
+func (p *WorkerPool) fill(queue <-chan *Outbox, batch []*Outbox) []*Outbox {
+	if len(batch) >= p.batchSize {
+		return batch
+	}
+	linger := time.NewTimer(p.linger)
+	defer linger.Stop()
+	for len(batch) < p.batchSize {
+		select {
+		case outbox, ok := <-queue:
+			if !ok {
+				return batch
+			}
+			queueDepth.Add(-1)
+			batch = append(batch, outbox)
+		case <-linger.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (p *WorkerPool) queue(outbox *Outbox) chan<- *Outbox {
+	hash := fnv.New32a()
+	hash.Write([]byte(p.ordering.RoutingKey(outbox)))
+	return p.queues[hash.Sum32()%uint32(len(p.queues))]
+}
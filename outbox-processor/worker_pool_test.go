@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolProcessesEveryRecord(t *testing.T) {
+	var mutex sync.Mutex
+	processed := map[string]int{}
+	pool := NewWorkerPool(4, 8, 3, time.Millisecond, DefaultOrderingPolicy(), func(_ context.Context, outboxes []*Outbox) {
+		if len(outboxes) > 3 {
+			t.Errorf("batch of %d records, want at most 3", len(outboxes))
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, outbox := range outboxes {
+			processed[outbox.Id]++
+		}
+	})
+	events := make(chan *Outbox)
+	go func() {
+		for i := range 100 {
+			events <- &Outbox{Id: strconv.Itoa(i)}
+		}
+		close(events)
+	}()
+
+	pool.Run(context.Background(), events)
+
+	if len(processed) != 100 {
+		t.Errorf("processed %d records, want 100", len(processed))
+	}
+	for id, count := range processed {
+		if count != 1 {
+			t.Errorf("record %s processed %d times", id, count)
+		}
+	}
+}
+
+func TestWorkerPoolBatchesQueuedRecords(t *testing.T) {
+	var batches [][]*Outbox
+	pool := NewWorkerPool(1, 10, 4, time.Second, DefaultOrderingPolicy(), func(_ context.Context, outboxes []*Outbox) {
+		batches = append(batches, outboxes)
+	})
+	events := make(chan *Outbox, 6)
+	for _, id := range []string{"1", "2", "3", "4", "5", "6"} {
+		events <- &Outbox{Id: id}
+	}
+	close(events)
+
+	pool.Run(context.Background(), events)
+
+	// The closed queue ends the second batch without waiting for the linger time.
+	if len(batches) != 2 || len(batches[0]) != 4 || len(batches[1]) != 2 {
+		t.Errorf("batch sizes %v, want [4 2]", batchSizes(batches))
+	}
+}
+
+func batchSizes(batches [][]*Outbox) []int {
+	sizes := make([]int, len(batches))
+	for i, batch := range batches {
+		sizes[i] = len(batch)
+	}
+	return sizes
+}
@@ -0,0 +1,85 @@
+// Package tracing carries the W3C trace context of a request, so the events raised
+// while handling it can be correlated with it wherever they are delivered.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+)
+
+// TraceContext is the trace a request belongs to, in the traceparent and tracestate
+// format of https://www.w3.org/TR/trace-context/.
+type TraceContext struct {
+	TraceId string
+	SpanId  string
+	Flags   string
+	State   string
+}
+
+type contextKey struct{}
+
+var traceParentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// Parse reads the traceparent and tracestate headers a request came with.
+func Parse(traceParent, traceState string) (TraceContext, error) {
+	match := traceParentPattern.FindStringSubmatch(strings.TrimSpace(traceParent))
+	if match == nil {
+		return TraceContext{}, errors.New("malformed traceparent")
+	}
+	if strings.Trim(match[1], "0") == "" || strings.Trim(match[2], "0") == "" {
+		return TraceContext{}, errors.New("traceparent has an all-zero id")
+	}
+	return TraceContext{TraceId: match[1], SpanId: match[2], Flags: match[3], State: strings.TrimSpace(traceState)}, nil
+}
+
+// New starts a sampled trace, for work that does not come with one.
+func New() TraceContext {
+	return TraceContext{TraceId: randomHex(16), SpanId: randomHex(8), Flags: "01"}
+}
+
+func (t TraceContext) TraceParent() string {
+	return "00-" + t.TraceId + "-" + t.SpanId + "-" + t.Flags
+}
+
+// Headers returns the headers propagating the trace context.
+func (t TraceContext) Headers() map[string]string {
+	headers := map[string]string{TraceParentHeader: t.TraceParent()}
+	if t.State != "" {
+		headers[TraceStateHeader] = t.State
+	}
+	return headers
+}
+
+func NewContext(ctx context.Context, trace TraceContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, trace)
+}
+
+func FromContext(ctx context.Context) (TraceContext, bool) {
+	trace, ok := ctx.Value(contextKey{}).(TraceContext)
+	return trace, ok
+}
+
+// Headers returns the headers propagating the trace context of ctx, or nil when it
+// carries none.
+func Headers(ctx context.Context) map[string]string {
+	trace, ok := FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return trace.Headers()
+}
+
+func randomHex(size int) string {
+	bytes := make([]byte, size)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
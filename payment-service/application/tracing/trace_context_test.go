@@ -0,0 +1,34 @@
+package tracing
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		traceParent string
+		valid       bool
+	}{
+		{traceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", valid: true},
+		{traceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", valid: true},
+		{traceParent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{traceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{traceParent: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{traceParent: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"},
+		{traceParent: ""},
+	} {
+		trace, err := Parse(test.traceParent, "")
+		if test.valid != (err == nil) {
+			t.Errorf("Parse(%q) error = %v, want valid %v", test.traceParent, err, test.valid)
+			continue
+		}
+		if test.valid && trace.TraceParent() != test.traceParent {
+			t.Errorf("Parse(%q).TraceParent() = %q", test.traceParent, trace.TraceParent())
+		}
+	}
+}
+
+func TestNewStartsAValidTrace(t *testing.T) {
+	trace := New()
+	if _, err := Parse(trace.TraceParent(), ""); err != nil {
+		t.Errorf("New().TraceParent() = %q: %v", trace.TraceParent(), err)
+	}
+}
@@ -1,8 +1,10 @@
 package process_payment
 
 import (
+	"context"
 	"transactional-outbox/application/event"
 	"transactional-outbox/application/gateway/payment"
+	"transactional-outbox/application/tracing"
 	"transactional-outbox/domain/events"
 )
 
@@ -26,7 +28,7 @@ func New(eventEmitter event.Emitter, paymentGateway payment.Gateway) *ProcessPay
 	return &ProcessPaymentUseCase{eventEmitter: eventEmitter, paymentGateway: paymentGateway}
 }
 
-func (uc *ProcessPaymentUseCase) Execute(input Input) error {
+func (uc *ProcessPaymentUseCase) Execute(ctx context.Context, input Input) error {
 	paymentInput := payment.Input{
 		CardNumber:         input.CardNumber,
 		CardHolderName:     input.CardHolderName,
@@ -36,7 +38,13 @@ func (uc *ProcessPaymentUseCase) Execute(input Input) error {
 	}
 	paymentOutput, err := uc.paymentGateway.Pay(paymentInput)
 	if err != nil {
-		return uc.eventEmitter.Emit(events.NewPaymentFailedEvent(input.PurchaseId, err.Error()))
+		return uc.emit(ctx, events.NewPaymentFailedEvent(input.PurchaseId, err.Error()))
 	}
-	return uc.eventEmitter.Emit(events.NewPaymentProcessedEvent(input.PurchaseId, paymentOutput.TransactionId))
+	return uc.emit(ctx, events.NewPaymentProcessedEvent(input.PurchaseId, paymentOutput.TransactionId))
+}
+
+// emit records the event with the trace context of the request that raised it.
+func (uc *ProcessPaymentUseCase) emit(ctx context.Context, event *events.Event) error {
+	event.Headers = tracing.Headers(ctx)
+	return uc.eventEmitter.Emit(event)
 }
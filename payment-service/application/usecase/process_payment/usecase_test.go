@@ -0,0 +1,73 @@
+package process_payment
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"transactional-outbox/application/gateway/payment"
+	"transactional-outbox/application/tracing"
+	"transactional-outbox/domain/events"
+)
+
+type recordingEmitter struct {
+	emitted []*events.Event
+}
+
+func (e *recordingEmitter) Emit(event *events.Event) error {
+	e.emitted = append(e.emitted, event)
+	return nil
+}
+
+type stubGateway struct {
+	err error
+}
+
+func (g stubGateway) Pay(payment.Input) (*payment.Output, error) {
+	if g.err != nil {
+		return nil, g.err
+	}
+	return &payment.Output{TransactionId: "transaction"}, nil
+}
+
+func TestExecuteRecordsTraceContextOnEvents(t *testing.T) {
+	trace, err := tracing.Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "vendor=value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		gateway stubGateway
+		event   string
+	}{
+		{name: "processed", gateway: stubGateway{}, event: "PAYMENT_PROCESSED"},
+		{name: "failed", gateway: stubGateway{err: errors.New("declined")}, event: "PAYMENT_FAILED"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			emitter := &recordingEmitter{}
+			ctx := tracing.NewContext(context.Background(), trace)
+			if err := New(emitter, test.gateway).Execute(ctx, Input{PurchaseId: "purchase", Amount: 10}); err != nil {
+				t.Fatal(err)
+			}
+			if len(emitter.emitted) != 1 || emitter.emitted[0].Name != test.event {
+				t.Fatalf("emitted %v, want one %s event", emitter.emitted, test.event)
+			}
+			headers := emitter.emitted[0].Headers
+			if got := headers[tracing.TraceParentHeader]; got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+				t.Errorf("traceparent = %q", got)
+			}
+			if got := headers[tracing.TraceStateHeader]; got != "vendor=value" {
+				t.Errorf("tracestate = %q", got)
+			}
+		})
+	}
+}
+
+func TestExecuteWithoutTraceContextSetsNoHeaders(t *testing.T) {
+	emitter := &recordingEmitter{}
+	if err := New(emitter, stubGateway{}).Execute(context.Background(), Input{PurchaseId: "purchase"}); err != nil {
+		t.Fatal(err)
+	}
+	if headers := emitter.emitted[0].Headers; headers != nil {
+		t.Errorf("headers = %v, want none", headers)
+	}
+}
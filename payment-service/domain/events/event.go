@@ -6,6 +6,10 @@ type Event struct {
 	ID      string            `json:"id,omitempty"`
 	Name    string            `json:"name,omitempty"`
 	Payload map[string]string `json:"payload,omitempty"`
+	// AggregateId groups the events that must be delivered in the order they were raised.
+	AggregateId string `json:"-"`
+	// Headers carry metadata delivered alongside the event, such as the W3C traceparent.
+	Headers map[string]string `json:"-"`
 }
 
 func NewPaymentProcessedEvent(purchaseId, transactionId string) *Event {
@@ -16,6 +20,7 @@ func NewPaymentProcessedEvent(purchaseId, transactionId string) *Event {
 			"purchaseId":    purchaseId,
 			"transactionId": transactionId,
 		},
+		AggregateId: purchaseId,
 	}
 }
 
@@ -27,5 +32,6 @@ func NewPaymentFailedEvent(purchaseId, reason string) *Event {
 			"purchaseId": purchaseId,
 			"reason":     reason,
 		},
+		AggregateId: purchaseId,
 	}
 }
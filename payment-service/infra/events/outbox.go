@@ -19,6 +19,7 @@ func (d *OutboxEventEmitter) Emit(event *events.Event) error {
 	if err != nil {
 		return err
 	}
-	outbox := repository.NewOutbox(event.ID, event.Name, string(payload))
+	outbox := repository.NewOutbox(event.ID, event.Name, event.AggregateId, string(payload))
+	outbox.Headers = event.Headers
 	return d.outboxRepository.Save(outbox)
 }
@@ -2,6 +2,8 @@ package repository
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
@@ -11,11 +13,13 @@ import (
 
 type (
 	Outbox struct {
-		Id        string    `json:"id" bson:"_id"`
-		Name      string    `json:"name" bson:"name"`
-		Payload   string    `json:"payload" bson:"payload"`
-		Status    string    `json:"status" bson:"status"`
-		CreatedAt time.Time `json:"created_at" bson:"created_at"`
+		Id          string            `json:"id" bson:"_id"`
+		Name        string            `json:"name" bson:"name"`
+		OrderingKey string            `json:"ordering_key,omitempty" bson:"ordering_key,omitempty"`
+		Payload     string            `json:"payload" bson:"payload"`
+		Headers     map[string]string `json:"headers,omitempty" bson:"headers,omitempty"`
+		Status      string            `json:"status" bson:"status"`
+		CreatedAt   time.Time         `json:"created_at" bson:"created_at"`
 	}
 
 	OutboxRepository interface {
@@ -30,15 +34,41 @@ type (
 		tableName    string
 		dynamoClient *dynamodb.DynamoDB
 	}
+
+	// SqlExecutor is implemented by both *sql.DB and *sql.Tx. Passing the caller's
+	// transaction saves the outbox record atomically with the change it announces.
+	SqlExecutor interface {
+		ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	}
+
+	postgresOutboxRepository struct {
+		tableName string
+		db        SqlExecutor
+	}
+
+	mySqlOutboxRepository struct {
+		tableName string
+		db        SqlExecutor
+	}
+
+	sqliteOutboxRepository struct {
+		tableName string
+		db        SqlExecutor
+	}
 )
 
-func NewOutbox(id, name, payload string) *Outbox {
+// sqliteTimeLayout is the UTC text created_at is stored as, which compares in
+// time order with the times the outbox processor writes.
+const sqliteTimeLayout = "2006-01-02 15:04:05.999999999-07:00"
+
+func NewOutbox(id, name, orderingKey, payload string) *Outbox {
 	return &Outbox{
-		Id:        id,
-		Name:      name,
-		Payload:   payload,
-		Status:    "PENDING",
-		CreatedAt: time.Now(),
+		Id:          id,
+		Name:        name,
+		OrderingKey: orderingKey,
+		Payload:     payload,
+		Status:      "PENDING",
+		CreatedAt:   time.Now(),
 	}
 }
 
@@ -50,6 +80,24 @@ func NewMongoOutboxRepository(collection *mongo.Collection) OutboxRepository {
 	return &mongoOutboxRepository{collection: collection}
 }
 
+// NewPostgresOutboxRepository saves records through db, usually the transaction
+// of the business change, into the table created by migrations/postgres.
+func NewPostgresOutboxRepository(tableName string, db SqlExecutor) OutboxRepository {
+	return &postgresOutboxRepository{tableName: tableName, db: db}
+}
+
+// NewMySqlOutboxRepository saves records through db, usually the transaction of
+// the business change, into the table created by migrations/mysql.
+func NewMySqlOutboxRepository(tableName string, db SqlExecutor) OutboxRepository {
+	return &mySqlOutboxRepository{tableName: tableName, db: db}
+}
+
+// NewSqliteOutboxRepository saves records through db, usually the transaction of
+// the business change, into the table created by migrations/sqlite.
+func NewSqliteOutboxRepository(tableName string, db SqlExecutor) OutboxRepository {
+	return &sqliteOutboxRepository{tableName: tableName, db: db}
+}
+
 func (r *mongoOutboxRepository) Save(outbox *Outbox) error {
 	_, err := r.collection.InsertOne(context.TODO(), outbox)
 	return err
@@ -67,3 +115,61 @@ func (r *dynamoDBOutboxRepository) Save(outbox *Outbox) error {
 	_, err = r.dynamoClient.PutItem(input)
 	return err
 }
+
+func (r *postgresOutboxRepository) Save(outbox *Outbox) error {
+	headers, err := headersColumn(outbox.Headers)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(
+		context.TODO(),
+		`INSERT INTO `+r.tableName+` (id, name, ordering_key, payload, headers, status, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7)`,
+		outbox.Id, outbox.Name, outbox.OrderingKey, outbox.Payload, headers, outbox.Status, outbox.CreatedAt,
+	)
+	return err
+}
+
+// Save stores created_at in UTC, which the outbox processor reads it as.
+func (r *mySqlOutboxRepository) Save(outbox *Outbox) error {
+	headers, err := headersColumn(outbox.Headers)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(
+		context.TODO(),
+		`INSERT INTO `+r.tableName+` (id, name, ordering_key, payload, headers, status, created_at)
+		VALUES (?, ?, NULLIF(?, ''), ?, ?, ?, ?)`,
+		outbox.Id, outbox.Name, outbox.OrderingKey, outbox.Payload, headers, outbox.Status, outbox.CreatedAt.UTC(),
+	)
+	return err
+}
+
+// Save formats created_at itself, so the layout does not depend on how the
+// connection was opened.
+func (r *sqliteOutboxRepository) Save(outbox *Outbox) error {
+	headers, err := headersColumn(outbox.Headers)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(
+		context.TODO(),
+		`INSERT INTO `+r.tableName+` (id, name, ordering_key, payload, headers, status, created_at)
+		VALUES (?, ?, NULLIF(?, ''), ?, ?, ?, ?)`,
+		outbox.Id, outbox.Name, outbox.OrderingKey, outbox.Payload, headers, outbox.Status,
+		outbox.CreatedAt.UTC().Format(sqliteTimeLayout),
+	)
+	return err
+}
+
+// headersColumn encodes the headers as JSON, or NULL when there are none.
+func headersColumn(headers map[string]string) (any, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(headers)
+	if err != nil {
+		return nil, err
+	}
+	return string(encoded), nil
+}
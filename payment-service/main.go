@@ -2,14 +2,22 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	_ "github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log/slog"
+	_ "modernc.org/sqlite"
+	"os"
+	"strings"
+	"transactional-outbox/application/tracing"
 	"transactional-outbox/application/usecase/process_payment"
 	"transactional-outbox/infra/events"
 	"transactional-outbox/infra/gateway"
@@ -18,18 +26,18 @@ import (
 
 const (
 	TableName           = "outbox_events"
-	AwsClientId         = "test"
-	AwsClientSecret     = "test"
-	AwsToken            = "test"
 	AwsEndpoint         = "http://localhost:4566"
 	AwsRegion           = "us-east-1"
 	MongoServer         = "mongodb://localhost:27017"
+	PostgresServer      = "postgres://localhost:5432/outbox?sslmode=disable"
+	MySqlServer         = "tcp(localhost:3306)/outbox?parseTime=true&loc=UTC"
+	SqliteDatabase      = "file:outbox.db?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
 	MongoDatabaseName   = "outbox"
 	MongoCollectionName = "events"
 )
 
 func main() {
-	outboxRepository := mongoOutboxRepository()
+	outboxRepository := outboxRepositoryFromEnv()
 	outboxEventEmitter := events.NewOutboxEventEmitter(outboxRepository)
 	paymentGateway := &gateway.VisaPaymentGateway{}
 	processPayment := process_payment.New(outboxEventEmitter, paymentGateway)
@@ -41,14 +49,36 @@ func main() {
 		CardExpirationDate: "10/2024",
 		CardCVV:            "123",
 	}
-	err := processPayment.Execute(input)
+	// A request would bring its traceparent along; this run starts a trace of its own.
+	ctx := tracing.NewContext(context.Background(), tracing.New())
+	err := processPayment.Execute(ctx, input)
 	if err != nil {
-		slog.Error("Payment process is failed", err)
+		slog.Error("Payment process is failed", "error", err)
 		return
 	}
 	slog.Info("Payment process is done")
 }
 
+// outboxRepositoryFromEnv connects to the backend selected by OUTBOX_BACKEND, as the
+// outbox processor reading the records does: mongodb, dynamodb, postgres, mysql or
+// sqlite.
+func outboxRepositoryFromEnv() repository.OutboxRepository {
+	switch backend := envString("OUTBOX_BACKEND", "mongodb"); backend {
+	case "mongodb":
+		return mongoOutboxRepository()
+	case "dynamodb":
+		return dynamoOutboxRepository()
+	case "postgres":
+		return postgresOutboxRepository()
+	case "mysql":
+		return mySqlOutboxRepository()
+	case "sqlite":
+		return sqliteOutboxRepository()
+	default:
+		panic(fmt.Sprintf("unknown outbox backend %q", backend))
+	}
+}
+
 func mongoOutboxRepository() repository.OutboxRepository {
 	clientOptions := options.Client().ApplyURI(MongoServer)
 	client, err := mongo.Connect(context.TODO(), clientOptions)
@@ -62,7 +92,7 @@ func mongoOutboxRepository() repository.OutboxRepository {
 func dynamoOutboxRepository() repository.OutboxRepository {
 	config := &aws.Config{
 		Region:           aws.String(AwsRegion),
-		Credentials:      credentials.NewStaticCredentials(AwsClientId, AwsClientSecret, AwsToken),
+		Credentials:      awsCredentials(),
 		Endpoint:         aws.String(AwsEndpoint),
 		S3ForcePathStyle: aws.Bool(true),
 	}
@@ -73,3 +103,66 @@ func dynamoOutboxRepository() repository.OutboxRepository {
 	dynamoClient := dynamodb.New(awsSession)
 	return repository.NewDynamoDBOutboxRepository(TableName, dynamoClient)
 }
+
+// awsCredentials reads the same OUTBOX_AWS_ACCESS_KEY_ID, OUTBOX_AWS_SECRET_ACCESS_KEY
+// and OUTBOX_AWS_SESSION_TOKEN as the outbox processor, each also from the file
+// named by its _FILE variable. Without them it returns nil so the SDK's default
+// chain applies: the AWS_* variables, the shared credentials file or the instance role.
+func awsCredentials() *credentials.Credentials {
+	accessKeyId := envSecret("OUTBOX_AWS_ACCESS_KEY_ID")
+	if accessKeyId == "" {
+		return nil
+	}
+	return credentials.NewStaticCredentials(accessKeyId, envSecret("OUTBOX_AWS_SECRET_ACCESS_KEY"), envSecret("OUTBOX_AWS_SESSION_TOKEN"))
+}
+
+func envString(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envSecret reads a credential from the file named by <key>_FILE, as mounted by
+// Docker and Kubernetes secrets, or else from the variable itself.
+func envSecret(key string) string {
+	if path := os.Getenv(key + "_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			panic(err)
+		}
+		return strings.TrimRight(string(content), "\r\n")
+	}
+	return os.Getenv(key)
+}
+
+// postgresOutboxRepository saves records outside of any transaction. Services
+// writing business data to the same database pass their *sql.Tx instead.
+func postgresOutboxRepository() repository.OutboxRepository {
+	db, err := sql.Open("pgx", PostgresServer)
+	if err != nil {
+		panic(err)
+	}
+	return repository.NewPostgresOutboxRepository(TableName, db)
+}
+
+// mySqlOutboxRepository saves records outside of any transaction. Services
+// writing business data to the same database pass their *sql.Tx instead.
+func mySqlOutboxRepository() repository.OutboxRepository {
+	db, err := sql.Open("mysql", MySqlServer)
+	if err != nil {
+		panic(err)
+	}
+	return repository.NewMySqlOutboxRepository(TableName, db)
+}
+
+// sqliteOutboxRepository saves records into the database file the outbox processor
+// reads, in WAL mode. Writers wait for SQLite's single write lock for up to the busy
+// timeout, and transactions take it as they begin.
+func sqliteOutboxRepository() repository.OutboxRepository {
+	db, err := sql.Open("sqlite", SqliteDatabase)
+	if err != nil {
+		panic(err)
+	}
+	return repository.NewSqliteOutboxRepository(TableName, db)
+}